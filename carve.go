@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultBufferSize is the write buffer size used by Carve
+	DefaultBufferSize = 16777216 // 32768 // 65536
+
+	// DefaultFileMode is the permission used for carved files (before umask)
+	DefaultFileMode os.FileMode = 0644
+)
+
+// CarveOptions control how CarveWith writes a file.
+// The zero value behaves like Carve.
+type CarveOptions struct {
+	// BufferSize is the size of the write buffer, DefaultBufferSize if zero
+	BufferSize int
+
+	// Mode is the permission of the created file, DefaultFileMode if zero
+	Mode os.FileMode
+
+	// Atomic writes to a temp file in the same directory and renames it
+	// into place once complete, so readers never see a partial file
+	Atomic bool
+
+	// Compress gzips the output
+	Compress bool
+
+	// Checksum, if set, is fed every byte written to the file
+	// (i.e. after compression), typically a hash.Hash
+	Checksum io.Writer
+
+	// Preallocate, if set, is the expected size of the file, which is
+	// reserved on disk before writing to reduce fragmentation. It is
+	// ignored when compressing, as the output size isn't known.
+	Preallocate int64
+
+	// PadTo, if set, pads the file with PadByte up to PadTo bytes.
+	// It is an error for the content to be longer. Padding is ignored
+	// when compressing, as it would corrupt the gzip stream.
+	PadTo   int64
+	PadByte byte
+}
+
+// Carve is a filewriter helper
+func Carve(r io.Reader, filename string) error {
+	_, err := CarveWith(r, filename, CarveOptions{})
+	return err
+}
+
+// CarveWith copies r into filename as specified by opts,
+// returning the number of bytes read from r.
+// On failure the partially written file is removed.
+func CarveWith(r io.Reader, filename string, opts CarveOptions) (int64, error) {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	var f *os.File
+	var err error
+	if opts.Atomic {
+		dir, base := filepath.Split(filename)
+		if dir == "" {
+			dir = "."
+		}
+		if f, err = os.CreateTemp(dir, "."+base+".*.tmp"); err == nil {
+			err = f.Chmod(mode)
+		}
+	} else {
+		f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return 0, err
+	}
+
+	if opts.Preallocate > 0 && !opts.Compress {
+		if err = preallocate(f, opts.Preallocate); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+	}
+	n, err := carve(r, f, size, opts)
+	if err == nil && opts.Atomic {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+	return n, nil
+}
+
+// SinkFactory creates where a chunk called name is written, such as an
+// upload or an in-memory buffer, in place of a file
+type SinkFactory func(name string) (io.WriteCloser, error)
+
+// CarveToSink is CarveWith writing to what sink creates for name rather
+// than to a file. Atomic and Preallocate don't apply, and on failure
+// the sink is closed but anything written is left to it to discard.
+func CarveToSink(r io.Reader, name string, sink SinkFactory, opts CarveOptions) (int64, error) {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	w, err := sink(name)
+	if err != nil {
+		return 0, err
+	}
+	opts.Preallocate = 0
+	return carve(r, w, size, opts)
+}
+
+// carve writes r to f through the buffer, compressor, and checksum
+// and always closes f
+func carve(r io.Reader, f io.WriteCloser, size int, opts CarveOptions) (int64, error) {
+	var dst io.Writer = f
+	if opts.Checksum != nil {
+		// hashing inline with the write benchmarked faster than handing
+		// copies of each buffer to a separate hashing goroutine
+		dst = io.MultiWriter(f, opts.Checksum)
+	}
+	bw := bufio.NewWriterSize(dst, size)
+	var w io.Writer = bw
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(bw)
+		w = gz
+	}
+	n, err := io.Copy(w, r)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	written := n
+	if err == nil && gz == nil && opts.PadTo > 0 {
+		err = pad(bw, n, opts.PadTo, opts.PadByte)
+		written = opts.PadTo
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && gz == nil && opts.Preallocate > written {
+		// r was shorter than expected, drop the unwritten reservation
+		err = f.(*os.File).Truncate(written)
+	}
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// contextReader fails reads once its context is done,
+// aborting an in-progress carve
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// pad writes padding after n bytes of content to make up size bytes
+func pad(w io.Writer, n, size int64, b byte) error {
+	if n > size {
+		return fmt.Errorf("%d bytes is over the %d to pad to", n, size)
+	}
+	p := bytes.Repeat([]byte{b}, 4096)
+	for left := size - n; left > 0; left -= int64(len(p)) {
+		if left < int64(len(p)) {
+			p = p[:left]
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
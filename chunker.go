@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// Chunker chunks any number of sources with the same Options,
+// for services that chunk many files alike
+type Chunker struct {
+	opts Options
+}
+
+// NewChunker returns a Chunker configured by opts
+func NewChunker(opts Options) *Chunker {
+	return &Chunker{opts: opts.withDefaults()}
+}
+
+// Chunk splits src into chunks in dir, as ChunkFileWith does
+func (c *Chunker) Chunk(src, dir string) (Result, error) {
+	return c.ChunkContext(context.Background(), src, dir)
+}
+
+// ChunkContext is Chunk, stopping early if ctx is cancelled
+// as ChunkFileContext does
+func (c *Chunker) ChunkContext(ctx context.Context, src, dir string) (Result, error) {
+	if err := c.prepareDir(dir); err != nil {
+		return Result{}, err
+	}
+	before, err := statSource(src)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var res Result
+	if c.opts.gzipped(src) {
+		res, err = c.chunkGzip(ctx, src, dir)
+	} else {
+		res, err = c.chunkFile(ctx, src, dir)
+	}
+	if err == nil {
+		// the mapping doesn't protect against the file changing under it
+		err = checkUnchanged(src, before)
+	}
+	if err = reportRun(dir, src, before, c.opts, res, err); err != nil {
+		return res, err
+	}
+	switch {
+	case c.opts.ErasePasses > 0:
+		err = SecureErasePattern(src, c.opts.ErasePasses, c.opts.ErasePattern)
+	case c.opts.RemoveSource:
+		err = os.Remove(src)
+	}
+	return res, err
+}
+
+// chunkFile maps src and chunks it
+func (c *Chunker) chunkFile(ctx context.Context, src, dir string) (Result, error) {
+	mf, err := openSource(src)
+	if err != nil {
+		return Result{}, err
+	}
+	defer mf.Close()
+	return c.chunk(ctx, mf, src, dir)
+}
+
+// chunkGzip decompresses src as it is read, chunking it as a stream
+// named as if the source were the decompressed file
+func (c *Chunker) chunkGzip(ctx context.Context, src, dir string) (Result, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return Result{}, fmt.Errorf("reading %q: %w", src, err)
+	}
+	defer zr.Close()
+	return c.stream(ctx, zr, strings.TrimSuffix(src, gzipExt), dir)
+}
+
+// ChunkStreamed splits r, such as a pipe, into chunks in dir as it is
+// read, decompressing it first if Options.GzipSource is set. Chunks are
+// by Size only and written one at a time, as with a gzipped source, but
+// unlike ChunkSpooled nothing more than a chunk is ever written to disk.
+// Skip and SkipUntil still apply to the start of the stream, and
+// Incomplete decides what becomes of a final record without a delim.
+func (c *Chunker) ChunkStreamed(ctx context.Context, r io.Reader, dir string) (Result, error) {
+	if err := c.prepareDir(dir); err != nil {
+		return Result{}, err
+	}
+	if c.opts.GzipSource {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return Result{}, fmt.Errorf("reading the source: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	res, err := c.stream(ctx, r, "", dir)
+	return res, reportRun(dir, "", nil, c.opts, res, err)
+}
+
+// stream carves r in chunks of Size bytes run on to the end of the
+// line, named for source, into dir
+func (c *Chunker) stream(ctx context.Context, r io.Reader, source, dir string) (Result, error) {
+	opts := c.opts
+	if opts.Key != nil || opts.Lines > 0 || opts.MaxChunks > 0 || opts.DropBlankTail || opts.CSV || opts.MinSize > 0 || opts.Overlap > 0 {
+		return Result{}, fmt.Errorf("a streamed source can only be chunked by size")
+	}
+	if opts.Sink != nil {
+		return Result{}, fmt.Errorf("a streamed source can't be chunked to a sink")
+	}
+	size := streamBufferSize
+	if opts.SearchPage > int64(size) {
+		size = int(opts.SearchPage)
+	}
+	var hold *holdReader
+	if opts.Incomplete == HoldIncomplete {
+		hold = newHoldReader(r, opts.delim())
+		r = hold
+	}
+	br := bufio.NewReaderSize(&contextReader{ctx, r}, size)
+	var header []byte
+	if opts.Header {
+		var err error
+		if header, err = br.ReadBytes(opts.delim()); err != nil && err != io.EOF {
+			return Result{}, fmt.Errorf("reading the header: %w", err)
+		}
+		// the header was the first line to skip or else is kept
+		if opts.Skip > 0 {
+			opts.Skip--
+		} else {
+			br = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(header), br), size)
+		}
+	}
+	br, skipped, err := skipStream(br, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if c.opts.Skip > 0 {
+		skipped += int64(len(header))
+	}
+	cv, err := newCarver(ctx, nil, source, dir, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if header != nil {
+		cv.setHeader(header)
+	}
+	cv.skipped = skipped
+	err = cv.wait(cv.stream(br, skipped))
+	res := cv.result()
+	res.Incomplete = hold.held()
+	res.summary(opts.Logger)
+	return res, err
+}
+
+// Plan returns the chunks that Chunk would write for src in dir without
+// writing anything, so that a split can be previewed. A gzipped source
+// can't be planned, as it would have to be decompressed to find its lines.
+func (c *Chunker) Plan(src, dir string) ([]Chunk, error) {
+	if c.opts.gzipped(src) {
+		return nil, fmt.Errorf("can't plan the chunks of gzipped %q", src)
+	}
+	mf, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+	return c.plan(mf, src, dir)
+}
+
+// plan returns the chunks of mf, named for src in dir
+func (c *Chunker) plan(mf ReaderAt, src, dir string) ([]Chunk, error) {
+	start, err := skipTo(mf, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	cv, err := newCarver(context.Background(), mf, src, dir, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	err = findSections(mf, start, int64(mf.Len()), cv.opts, func(s Section) error {
+		i := cv.next()
+		name, err := cv.name(i, s)
+		if err != nil {
+			return fmt.Errorf("naming section %d: %w", i, err)
+		}
+		size := s.end - s.off
+		if s.off > 0 {
+			size += int64(len(cv.header))
+		}
+		chunks = append(chunks, Chunk{Index: i, Name: name, Section: s, Size: size})
+		return nil
+	})
+	return chunks, err
+}
+
+// ChunkLines is a planned chunk with the number of lines of the source
+// it holds, i.e. of delimiters, so those of all the chunks add up to
+// the lines of the whole source
+type ChunkLines struct {
+	Chunk
+	Lines int64
+}
+
+// CountLines plans the chunks of src, as Plan does, and counts the lines
+// each would hold, on as many workers as chunking would use, so that how
+// evenly a source would be split can be checked without writing anything
+func (c *Chunker) CountLines(ctx context.Context, src string) ([]ChunkLines, error) {
+	if c.opts.gzipped(src) {
+		return nil, fmt.Errorf("can't plan the chunks of gzipped %q", src)
+	}
+	mf, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+	chunks, err := c.plan(mf, src, "")
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]ChunkLines, len(chunks))
+	g, gctx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(c.opts.Workers))
+	for i := range chunks {
+		if err = sem.Acquire(gctx, 1); err != nil {
+			break
+		}
+		i := i
+		g.Go(func() error {
+			defer sem.Release(1)
+			n, err := countDelims(mf, chunks[i].Section, c.opts.delim())
+			counts[i] = ChunkLines{chunks[i], n}
+			return err
+		})
+	}
+	if gerr := g.Wait(); gerr != nil {
+		return nil, gerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// ChunkReader splits r into chunks in dir. Without a source file the
+// chunks take no extension unless Options.Ext is set, and RemoveSource
+// and ErasePasses don't apply.
+func (c *Chunker) ChunkReader(r ReaderAt, dir string) (Result, error) {
+	if err := c.prepareDir(dir); err != nil {
+		return Result{}, err
+	}
+	res, err := c.chunk(context.Background(), r, "", dir)
+	return res, reportRun(dir, "", nil, c.opts, res, err)
+}
+
+// chunk carves the sections of mf, named for source, into dir
+func (c *Chunker) chunk(ctx context.Context, mf ReaderAt, source, dir string) (Result, error) {
+	opts := c.opts
+	if opts.Incomplete == HoldIncomplete {
+		return Result{}, fmt.Errorf("only a streamed source can hold back an incomplete record")
+	}
+	start, err := skipTo(mf, opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	opts.debugf("chunkng with %d threads\n", opts.Workers)
+	cv, err := newCarver(ctx, mf, source, dir, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	cv.skipped = start
+	cv.total = int64(mf.Len()) - start
+	err = cv.wait(findSections(mf, start, int64(mf.Len()), cv.opts, cv.add))
+	res := cv.result()
+	res.summary(opts.Logger)
+	return res, err
+}
+
+// prepareDir prepares dir for the chunks, unless they go to a sink
+// and there's no metadata to write there either
+func (c *Chunker) prepareDir(dir string) error {
+	meta := c.opts.Checksums || c.opts.WriteReport || c.opts.PadTo > 0
+	if c.opts.Sink != nil && (!meta || c.opts.MetaDir != "") {
+		return nil
+	}
+	return prepareDir(dir)
+}
+
+// prepareDir creates dir if need be and checks it can be written to
+func prepareDir(dir string) error {
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return err
+	}
+	return checkWritable(dir)
+}
+
+// ChunkSpooled copies r, such as a pipe, to a temporary file in dir and
+// chunks that in parallel as if it were the source, trading the disk
+// for the copy for the speed of carving from a mapped file. The
+// temporary file is removed afterwards. With Options.GzipSource it is
+// the decompressed source that is spooled.
+func (c *Chunker) ChunkSpooled(ctx context.Context, r io.Reader, dir string) (Result, error) {
+	if err := prepareDir(dir); err != nil {
+		return Result{}, err
+	}
+	f, err := os.CreateTemp(dir, ".shred-spool-*")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.Remove(f.Name())
+	if c.opts.GzipSource {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return Result{}, fmt.Errorf("reading the source: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	_, err = io.Copy(f, &contextReader{ctx, r})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("spooling: %w", err)
+	}
+
+	mf, err := openSource(f.Name())
+	if err != nil {
+		return Result{}, err
+	}
+	defer mf.Close()
+	res, err := c.chunk(ctx, mf, "", dir)
+	return res, reportRun(dir, "", nil, c.opts, res, err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// recordIterator yields the offsets of the CSV records of a ReaderAt,
+// joining lines that end inside a quoted field, as a quoted value may
+// hold newlines of its own
+type recordIterator struct {
+	mf    ReaderAt
+	it    *LineIterator
+	line  []byte
+	start int64
+	end   int64
+	err   error
+}
+
+func csvRecords(mf ReaderAt, start int64, delim byte) *recordIterator {
+	return &recordIterator{mf: mf, it: lineIter(mf, start, delim)}
+}
+
+// Next advances to the next record, returning false at the end of
+// the source or on a read error
+func (r *recordIterator) Next() bool {
+	quoted, started := false, false
+	for r.it.Next() {
+		start, end := r.it.Line()
+		if !started {
+			r.start, started = start, true
+		}
+		r.end = end
+		if n := int(end - start); cap(r.line) < n {
+			r.line = make([]byte, n)
+		} else {
+			r.line = r.line[:n]
+		}
+		if _, err := r.mf.ReadAt(r.line, start); err != nil && err != io.EOF {
+			r.err = err
+			return false
+		}
+		// an escaped quote is doubled, so only an odd count changes state
+		if bytes.Count(r.line, []byte{'"'})%2 == 1 {
+			quoted = !quoted
+		}
+		if !quoted {
+			return true
+		}
+	}
+	// an unterminated quote runs to the end of the source
+	r.err = r.it.Err()
+	return r.err == nil && started
+}
+
+// Line returns the offset of the current record and the offset just
+// past it, including its newline
+func (r *recordIterator) Line() (int64, int64) {
+	return r.start, r.end
+}
+
+// Err returns the read error that stopped the iteration, if any
+func (r *recordIterator) Err() error {
+	return r.err
+}
+
+// sectionsByCSV calls fn with sections of whole CSV records between
+// off and end, of opts.Lines records if that is set or else of no more
+// than opts.Size unless a single record is bigger
+func sectionsByCSV(mf ReaderAt, off, end int64, opts Options, fn func(Section) error) error {
+	if opts.Key != nil || opts.MaxChunks > 0 {
+		return fmt.Errorf("CSV records can only be chunked by size or lines")
+	}
+	start, last := off, off
+	var count int
+	rec := csvRecords(mf, off, opts.delim())
+	for rec.Next() {
+		_, next := rec.Line()
+		if next > end {
+			break
+		}
+		if opts.Lines > 0 {
+			if count++; count == opts.Lines {
+				opts.debugf("chunk from %016d:%012d (%16d)\n", start, next, next-start)
+				if err := fn(Section{start, next}); err != nil {
+					return err
+				}
+				start, count = next, 0
+			}
+			continue
+		}
+		if next-start > opts.Size && last > start {
+			opts.debugf("chunk from %016d:%012d (%16d)\n", start, last, last-start)
+			if err := fn(Section{start, last}); err != nil {
+				return err
+			}
+			start = last
+		}
+		last = next
+	}
+	if err := rec.Err(); err != nil {
+		return err
+	}
+	if start < end {
+		opts.debugf("chunk from %016d:%012d (%16d)\n", start, end, end-start)
+		return fn(Section{start, end})
+	}
+	return nil
+}
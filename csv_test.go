@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+func TestSectionsByCSV(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,note\n")
+	for i := 0; i < 50; i++ {
+		b.WriteString(`1,"a note` + "\n" + `over ""two"" lines"` + "\n")
+		b.WriteString("2,plain\r\n")
+	}
+	data := b.String()
+	for _, opts := range []Options{{Size: 16, CSV: true}, {Size: 100, CSV: true}, {Lines: 3, CSV: true}} {
+		sections := sectionsOf(t, data, opts)
+		checkCover(t, sections, int64(len(data)))
+		var records int
+		for i, s := range sections {
+			// each section parses as whole records by itself
+			rs, err := csv.NewReader(strings.NewReader(data[s.off:s.end])).ReadAll()
+			if err != nil {
+				t.Fatalf("%+v: section %d %v splits a record: %v", opts, i, s, err)
+			}
+			if opts.Lines > 0 && i < len(sections)-1 && len(rs) != opts.Lines {
+				t.Errorf("section %d has %d records, want %d", i, len(rs), opts.Lines)
+			}
+			records += len(rs)
+		}
+		if records != 101 {
+			t.Errorf("%+v: got %d records, want 101", opts, records)
+		}
+	}
+}
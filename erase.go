@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SecureErase overwrites filename with random data passes times,
+// syncing after each pass, then truncates and removes it.
+//
+// This is best effort: journaling and copy-on-write filesystems, SSD wear
+// leveling, and snapshots can all retain the original data, so it is no
+// substitute for full disk encryption.
+func SecureErase(filename string, passes int) error {
+	return SecureErasePattern(filename, passes, nil)
+}
+
+// SecureErasePattern is SecureErase overwriting with pattern repeated,
+// e.g. []byte{0} to zero the file, rather than random data if it's empty
+func SecureErasePattern(filename string, passes int, pattern []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for pass := 0; pass < passes; pass++ {
+		if err := overwrite(f, fi.Size(), pattern); err != nil {
+			f.Close()
+			return fmt.Errorf("erase pass %d of %q: %w", pass+1, filename, err)
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// overwrite size bytes of f from the start with pattern repeated,
+// or random data if it's empty
+func overwrite(f *os.File, size int64, pattern []byte) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var r io.Reader = rand.Reader
+	if len(pattern) > 0 {
+		r = &repeatReader{pattern: pattern}
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// repeatReader reads pattern over and over
+type repeatReader struct {
+	pattern []byte
+	pos     int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		m := copy(p[n:], r.pattern[r.pos:])
+		n += m
+		r.pos = (r.pos + m) % len(r.pattern)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestOverwritePattern(t *testing.T) {
+	src := writeSource(t, lines(1, 1000))
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(lines(1, 1000)))
+	err = overwrite(f, size, []byte{0xff, 0x00, 0x5a})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte{0xff, 0x00, 0x5a}, len(got)/3+1)[:size]
+	if !bytes.Equal(got, want) {
+		t.Fatal("file isn't the pattern repeated")
+	}
+}
+
+func TestSecureErasePattern(t *testing.T) {
+	src := writeSource(t, lines(1, 10))
+	if err := SecureErasePattern(src, 2, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("source still there: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// frameHeaderSize is the size of a frame header: the chunk index
+// then its length, each a big-endian uint64
+const frameHeaderSize = 16
+
+// WriteFrames writes the chunks of filename to w in index order, each
+// framed by a header of its index and length so that a FrameReader on
+// the other end of a pipe can tell them apart. Nothing is written to
+// disk, which suits pipelines without a shared filesystem. The source
+// is mapped, so it can't be gzipped, and Header isn't repeated, so
+// it can't be set.
+func WriteFrames(filename string, w io.Writer, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+	if opts.gzipped(filename) {
+		return Result{}, fmt.Errorf("can't frame the chunks of gzipped %q", filename)
+	}
+	if opts.Header {
+		return Result{}, fmt.Errorf("framed chunks can't repeat the header")
+	}
+	mf, err := openSource(filename)
+	if err != nil {
+		return Result{}, err
+	}
+	defer mf.Close()
+	before, err := os.Stat(filename)
+	if err != nil {
+		return Result{}, err
+	}
+
+	start, err := skipTo(mf, opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	began := time.Now()
+	res := Result{Skipped: start}
+	bw := bufio.NewWriterSize(w, DefaultBufferSize)
+	idx := opts.StartIndex
+	err = findSections(mf, start, int64(mf.Len()), opts, func(s Section) error {
+		var hdr [frameHeaderSize]byte
+		binary.BigEndian.PutUint64(hdr[:8], uint64(idx))
+		binary.BigEndian.PutUint64(hdr[8:], uint64(s.end-s.off))
+		if _, err := bw.Write(hdr[:]); err != nil {
+			return err
+		}
+		n, err := io.Copy(bw, s.Reader(mf))
+		if err != nil {
+			return fmt.Errorf("framing section %d: %w", idx, err)
+		}
+		res.Chunks = append(res.Chunks, Chunk{Index: idx, Name: "-", Section: s, Size: n})
+		res.Bytes += n
+		idx++
+		if opts.Progress != nil {
+			opts.Progress(Progress{
+				Last:     res.Chunks[len(res.Chunks)-1],
+				Chunks:   len(res.Chunks),
+				Sections: len(res.Chunks),
+				Bytes:    res.Bytes,
+				Total:    int64(mf.Len()) - start,
+			})
+		}
+		return nil
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = checkUnchanged(filename, before)
+	}
+	res.Duration = time.Since(began)
+	res.summary(opts.Logger)
+	return res, err
+}
+
+// FrameReader reads the chunks written by WriteFrames. Next advances to
+// the following chunk, which is then read by Read, in the manner of
+// archive/tar.Reader.
+type FrameReader struct {
+	r      io.Reader
+	remain int64
+}
+
+// NewFrameReader returns a FrameReader reading frames from r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Next skips whatever is unread of the current chunk and returns the
+// index and length of the next one, or io.EOF when there are no more
+func (f *FrameReader) Next() (int, int64, error) {
+	if f.remain > 0 {
+		if _, err := io.CopyN(io.Discard, f.r, f.remain); err != nil {
+			return 0, 0, unexpected(err)
+		}
+		f.remain = 0
+	}
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, 0, fmt.Errorf("truncated frame header: %w", err)
+		}
+		return 0, 0, err
+	}
+	f.remain = int64(binary.BigEndian.Uint64(hdr[8:]))
+	return int(binary.BigEndian.Uint64(hdr[:8])), f.remain, nil
+}
+
+// Read reads from the current chunk, returning io.EOF at its end
+func (f *FrameReader) Read(b []byte) (int, error) {
+	if f.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > f.remain {
+		b = b[:f.remain]
+	}
+	n, err := f.r.Read(b)
+	f.remain -= int64(n)
+	if err == io.EOF && f.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// unexpected reports an EOF in the middle of a frame as such
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
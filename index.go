@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/exp/mmap"
+)
+
+// IndexExt is appended to the output filename to name its index
+const IndexExt = ".idx"
+
+// IndexFile writes the source into the single file dest, plus an index
+// (dest + IndexExt) of the newline aligned boundaries that ChunkFile
+// would have split it on. Each index line is "offset,length" relative to dest.
+// The first skip lines are left out of the output.
+func IndexFile(source, dest string, size int64, skip int) error {
+	return IndexFileWith(source, dest, Options{Size: size, Skip: skip})
+}
+
+// IndexFileWith is IndexFile with the boundaries that ChunkFileWith
+// would split on given opts. The lines skipped are left out of dest,
+// and as there is only the one file Header can't be repeated. The
+// offsets are of the source as it is, so it can't be gzipped.
+func IndexFileWith(source, dest string, opts Options) error {
+	opts = opts.withDefaults()
+	if opts.Header {
+		return fmt.Errorf("an indexed file can't repeat the header")
+	}
+	if opts.gzipped(source) {
+		return fmt.Errorf("can't index gzipped %q", source)
+	}
+	mf, err := openSource(source)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+
+	start, err := skipTo(mf, opts)
+	if err != nil {
+		return err
+	}
+	var sections []Section
+	err = findSections(mf, start, int64(mf.Len()), opts, func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest + IndexExt)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range sections {
+		fmt.Fprintf(w, "%d,%d\n", s.off-start, s.end-s.off)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return Carve(Section{start, int64(mf.Len())}.Reader(mf), dest)
+}
+
+// Indexed is a single file holding logical chunks listed in an index
+type Indexed struct {
+	mf      *mmap.ReaderAt
+	offsets []int64
+	lengths []int64
+}
+
+// OpenIndexed opens a file written by IndexFile along with its index
+func OpenIndexed(file, index string) (*Indexed, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	x := &Indexed{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var off, length int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%d,%d", &off, &length); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid index entry: %w", index, line, err)
+		}
+		x.offsets = append(x.offsets, off)
+		x.lengths = append(x.lengths, length)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if x.mf, err = openSource(file); err != nil {
+		return nil, err
+	}
+	for i, off := range x.offsets {
+		if off+x.lengths[i] > int64(x.mf.Len()) {
+			x.mf.Close()
+			return nil, fmt.Errorf("%s: entry %d extends past the end of %s", index, i, file)
+		}
+	}
+	return x, nil
+}
+
+// Len returns the number of indexed chunks
+func (x *Indexed) Len() int {
+	return len(x.offsets)
+}
+
+// Reader returns a reader for the i'th indexed chunk
+func (x *Indexed) Reader(i int) io.Reader {
+	return &mreader{x.mf, x.offsets[i], x.lengths[i]}
+}
+
+// Close releases the underlying file
+func (x *Indexed) Close() error {
+	return x.mf.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// KeyFunc returns the key of a line, given without its line ending.
+// The line is only valid for the duration of the call.
+type KeyFunc func(line []byte) []byte
+
+// ChunksByKeyChange returns the sections of filename holding runs of
+// lines with the same key, e.g. a column's value, so that each can be
+// carved with FileChunks without re-reading its lines. The lines must
+// be sorted by key, in any order, e.g. numeric, reversed or collated by
+// the locale, as a key that turns up again later starts another section.
+func ChunksByKeyChange(filename string, key KeyFunc) ([]Section, error) {
+	mf, err := openSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+
+	var sections []Section
+	err = sectionsByKey(mf, 0, int64(mf.Len()), key, '\n', func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	return sections, err
+}
+
+// sectionsByKey calls fn with each run of lines, ended by delim, with
+// the same key between off and end
+func sectionsByKey(mf ReaderAt, off, end int64, key KeyFunc, delim byte, fn func(Section) error) error {
+	var (
+		line  []byte
+		prev  []byte
+		start = off
+	)
+	it := lineIter(mf, off, delim)
+	for it.Next() {
+		lstart, lend := it.Line()
+		if lend > end {
+			break
+		}
+		if size := int(lend - lstart); cap(line) < size {
+			line = make([]byte, size)
+		} else {
+			line = line[:size]
+		}
+		if _, err := mf.ReadAt(line, lstart); err != nil && err != io.EOF {
+			return err
+		}
+		k := key(trimDelim(line, delim))
+		if lstart > start && !bytes.Equal(k, prev) {
+			if err := fn(Section{start, lstart}); err != nil {
+				return err
+			}
+			start = lstart
+		}
+		prev = append(prev[:0], k...)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if start < end {
+		return fn(Section{start, end})
+	}
+	return nil
+}
+
+// FieldKey returns a KeyFunc for the field of a line at index, counting
+// from 0, where fields are separated by sep, e.g. FieldKey(',', 2) for
+// the third column of a CSV without quoted fields. Lines with fewer
+// fields have an empty key.
+func FieldKey(sep byte, index int) KeyFunc {
+	return func(line []byte) []byte {
+		for i := 0; i < index; i++ {
+			j := bytes.IndexByte(line, sep)
+			if j < 0 {
+				return nil
+			}
+			line = line[j+1:]
+		}
+		if j := bytes.IndexByte(line, sep); j >= 0 {
+			line = line[:j]
+		}
+		return line
+	}
+}
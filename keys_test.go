@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChunksByKeyChange(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"ascending", "a\t1\na\t2\nb\t3\nc\t4\nc\t5\n", []string{"a", "b", "c"}},
+		{"numeric", "9\tx\n10\ty\n10\tz\n", []string{"9", "10"}},
+		{"reversed", "b\tx\na\ty\n", []string{"b", "a"}},
+		{"no trailing newline", "a\t1\nb\t2", []string{"a", "b"}},
+		{"whole line", "a\t1\nnone\nnone\n", []string{"a", "none"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sections, err := ChunksByKeyChange(writeSource(t, tc.data), FieldKey('\t', 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCover(t, sections, int64(len(tc.data)))
+			if len(sections) != len(tc.want) {
+				t.Fatalf("got %d sections, want %d", len(sections), len(tc.want))
+			}
+			for i, s := range sections {
+				for _, line := range strings.SplitAfter(tc.data[s.off:s.end], "\n") {
+					if line == "" {
+						continue
+					}
+					if key := string(FieldKey('\t', 0)([]byte(strings.TrimSuffix(line, "\n")))); key != tc.want[i] {
+						t.Errorf("section %d holds key %q, want %q", i, key, tc.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFieldKey(t *testing.T) {
+	line := []byte("a,b,c")
+	// a line without the field has an empty key
+	for i, want := range []string{"a", "b", "c", ""} {
+		if got := string(FieldKey(',', i)(line)); got != want {
+			t.Errorf("field %d is %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// lineScanSize is how much is read at a time when counting lines
+const lineScanSize = 1 << 20
+
+// LineIterator yields the offsets of the lines of a ReaderAt, reading
+// a page at a time so that the source is never loaded whole
+type LineIterator struct {
+	r     ReaderAt
+	delim byte
+	buf   []byte
+	base  int64 // offset of buf
+	pos   int64 // start of the next line
+	start int64
+	end   int64
+	err   error
+}
+
+// LineIter returns an iterator over the lines of r from start:
+//
+//	for it := LineIter(r, 0); it.Next(); {
+//		start, end := it.Line()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+func LineIter(r ReaderAt, start int64) *LineIterator {
+	return lineIter(r, start, '\n')
+}
+
+// lineIter is LineIter for records ended by delim
+func lineIter(r ReaderAt, start int64, delim byte) *LineIterator {
+	return &LineIterator{r: r, delim: delim, base: start, pos: start}
+}
+
+// Next advances to the next line, returning false at the end of the
+// source or on a read error
+func (it *LineIterator) Next() bool {
+	size := int64(it.r.Len())
+	if it.err != nil || it.pos >= size {
+		return false
+	}
+	it.start = it.pos
+	for {
+		if it.pos >= it.base+int64(len(it.buf)) {
+			if it.err = it.fill(it.pos, size); it.err != nil {
+				return false
+			}
+		}
+		if i := bytes.IndexByte(it.buf[it.pos-it.base:], it.delim); i >= 0 {
+			it.pos += int64(i) + 1
+			break
+		}
+		// the line carries on into the next page, if there is one
+		if it.pos = it.base + int64(len(it.buf)); it.pos >= size {
+			break
+		}
+	}
+	it.end = it.pos
+	return true
+}
+
+// fill reads the page at off
+func (it *LineIterator) fill(off, size int64) error {
+	n := size - off
+	if n > lineScanSize {
+		n = lineScanSize
+	}
+	if it.buf == nil {
+		it.buf = make([]byte, lineScanSize)
+	}
+	it.buf = it.buf[:n]
+	it.base = off
+	m, err := it.r.ReadAt(it.buf, off)
+	if err == io.EOF && int64(m) == n {
+		err = nil
+	}
+	return err
+}
+
+// Line returns the offset of the current line and the offset just past
+// it, including its newline. The last line of a source that doesn't end
+// in a newline ends at the end of the source.
+func (it *LineIterator) Line() (int64, int64) {
+	return it.start, it.end
+}
+
+// Err returns the read error that stopped the iteration, if any
+func (it *LineIterator) Err() error {
+	return it.err
+}
+
+// ChunksByLines returns a list of sections of the given number of lines.
+// The last section holds whatever lines remain, including a final line
+// without a trailing newline.
+func ChunksByLines(filename string, lines int) ([]Section, error) {
+	mf, err := openSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+
+	var sections []Section
+	opts := Options{Lines: lines}.withDefaults()
+	err = sectionsByLines(mf, 0, int64(mf.Len()), opts, func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	return sections, err
+}
+
+// sectionsByLines calls fn with sections of opts.Lines lines between off and end
+func sectionsByLines(mf ReaderAt, off, end int64, opts Options, fn func(Section) error) error {
+	start := off
+	var count int
+	it := lineIter(mf, off, opts.delim())
+	for it.Next() {
+		_, next := it.Line()
+		if next > end {
+			break
+		}
+		if count++; count == opts.Lines {
+			opts.debugf("chunk from %016d:%012d (%16d)\n", start, next, next-start)
+			if err := fn(Section{start, next}); err != nil {
+				return err
+			}
+			start, count = next, 0
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if start < end {
+		opts.debugf("chunk from %016d:%012d (%16d)\n", start, end, end-start)
+		return fn(Section{start, end})
+	}
+	return nil
+}
+
+// findSections calls fn with each section between off and end,
+// split into CSV records if opts.CSV is set, by key if opts.Key is,
+// by lines if opts.Lines is, into opts.MaxChunks if that is,
+// otherwise by size
+func findSections(mf ReaderAt, off, end int64, opts Options, fn func(Section) error) error {
+	if opts.Overlap > 0 {
+		return overlapSections(mf, opts, fn, func(fn func(Section) error) error {
+			opts.Overlap = 0
+			return findSections(mf, off, end, opts, fn)
+		})
+	}
+	if opts.MinSize > 0 {
+		return mergeSmallTail(opts.MinSize, fn, func(fn func(Section) error) error {
+			opts.MinSize = 0
+			return findSections(mf, off, end, opts, fn)
+		})
+	}
+	if opts.DropBlankTail {
+		return dropBlankTail(mf, fn, func(fn func(Section) error) error {
+			opts.DropBlankTail = false
+			return findSections(mf, off, end, opts, fn)
+		})
+	}
+	fn = dropEmpty(opts, fn)
+	switch {
+	case opts.CSV:
+		return sectionsByCSV(mf, off, end, opts, fn)
+	case opts.Key != nil:
+		return sectionsByKey(mf, off, end, opts.Key, opts.delim(), fn)
+	case opts.Lines > 0:
+		return sectionsByLines(mf, off, end, opts, fn)
+	case opts.MaxChunks > 0:
+		return sectionsByCount(mf, off, end, opts, fn)
+	}
+	return sectionsBySize(mf, off, end, opts, fn)
+}
+
+// dropEmpty wraps fn to leave out, with a warning, any section holding
+// nothing, such as that of an empty source, rather than write an empty chunk
+func dropEmpty(opts Options, fn func(Section) error) func(Section) error {
+	return func(s Section) error {
+		if s.end <= s.off {
+			opts.Logger.Printf("warning: dropping empty section at %d\n", s.off)
+			return nil
+		}
+		return fn(s)
+	}
+}
+
+// overlapSections runs find, moving the start of each section it finds
+// after the first back to the first line starting at most opts.Overlap
+// bytes before it, before passing it on to fn. No section is moved back
+// as far as the start of the one before, and one whose previous line
+// is longer than opts.Overlap isn't moved at all.
+func overlapSections(mf ReaderAt, opts Options, fn func(Section) error, find func(func(Section) error) error) error {
+	prev := int64(-1)
+	return find(func(s Section) error {
+		off := s.off
+		if prev >= 0 {
+			from := s.off - opts.Overlap
+			if from <= prev {
+				from = prev + 1
+			}
+			var err error
+			if s.off, err = nextLineEnd(mf, from-1, s.off, opts.SearchPage, opts.delim()); err != nil {
+				return err
+			}
+		}
+		prev = off
+		return fn(s)
+	})
+}
+
+// mergeSmallTail runs find, passing each section it finds on to fn two
+// behind, so that the last can be merged into the one before if it's
+// smaller than minSize
+func mergeSmallTail(minSize int64, fn func(Section) error, find func(func(Section) error) error) error {
+	var held []Section
+	err := find(func(s Section) error {
+		if len(held) == 2 {
+			if err := fn(held[0]); err != nil {
+				return err
+			}
+			held = held[1:]
+		}
+		held = append(held, s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(held) == 2 && held[1].end-held[1].off < minSize {
+		held = []Section{{held[0].off, held[1].end}}
+	}
+	for _, s := range held {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropBlankTail runs find, passing each section it finds on to fn one
+// behind, so that the last can be dropped if it's only whitespace
+func dropBlankTail(mf ReaderAt, fn func(Section) error, find func(func(Section) error) error) error {
+	var held *Section
+	err := find(func(s Section) error {
+		if held != nil {
+			if err := fn(*held); err != nil {
+				return err
+			}
+		}
+		held = &s
+		return nil
+	})
+	if err != nil || held == nil {
+		return err
+	}
+	blank, err := isBlank(mf, *held)
+	if err != nil || blank {
+		return err
+	}
+	return fn(*held)
+}
+
+// isBlank reports whether s holds nothing but whitespace
+func isBlank(mf ReaderAt, s Section) (bool, error) {
+	buf := make([]byte, lineScanSize)
+	for pos := s.off; pos < s.end; {
+		if int64(len(buf)) > s.end-pos {
+			buf = buf[:s.end-pos]
+		}
+		n, err := mf.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if len(bytes.TrimSpace(buf[:n])) > 0 {
+			return false, nil
+		}
+		pos += int64(n)
+	}
+	return true, nil
+}
+
+// lineOffset returns the offset just past lines lines, ended by delim,
+// from off, or end if there are fewer, with how many there were
+func lineOffset(mf ReaderAt, off, end int64, lines int, delim byte) (int64, int, error) {
+	it := lineIter(mf, off, delim)
+	var count int
+	for count < lines && it.Next() {
+		_, next := it.Line()
+		if next > end {
+			return end, count, nil
+		}
+		off = next
+		count++
+	}
+	return off, count, it.Err()
+}
+
+// firstLine returns the first line of mf, including its delim
+func firstLine(mf ReaderAt, delim byte) ([]byte, error) {
+	end, _, err := lineOffset(mf, 0, int64(mf.Len()), 1, delim)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, end)
+	if _, err := mf.ReadAt(line, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return line, nil
+}
+
+// trimDelim trims the delim off the end of line,
+// and a carriage return before a newline
+func trimDelim(line []byte, delim byte) []byte {
+	if delim == '\n' {
+		return bytes.TrimRight(line, "\r\n")
+	}
+	return bytes.TrimSuffix(line, []byte{delim})
+}
+
+// countDelims counts the delims in s, a page at a time
+func countDelims(mf ReaderAt, s Section, delim byte) (int64, error) {
+	buf := make([]byte, lineScanSize)
+	var count int64
+	for pos := s.off; pos < s.end; {
+		if int64(len(buf)) > s.end-pos {
+			buf = buf[:s.end-pos]
+		}
+		n, err := mf.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		count += int64(bytes.Count(buf[:n], []byte{delim}))
+		pos += int64(n)
+	}
+	return count, nil
+}
+
+// ExtractLines copies lines start through end of filename, counting
+// from 1 as sed(1) does, to dest. Only the part of the file up to the
+// last line is read, and the lines are streamed rather than buffered.
+// An end past the last line copies to the end of the file.
+func ExtractLines(filename, dest string, start, end int) error {
+	if start < 1 || end < start {
+		return fmt.Errorf("invalid line range %d-%d", start, end)
+	}
+	mf, err := openSource(filename)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+
+	size := int64(mf.Len())
+	off, found, err := lineOffset(mf, 0, size, start-1, '\n')
+	if err != nil {
+		return err
+	}
+	if off == size {
+		return fmt.Errorf("%q has only %d lines", filename, found)
+	}
+	last, _, err := lineOffset(mf, off, size, end-start+1, '\n')
+	if err != nil {
+		return err
+	}
+	_, err = CarveWith(Section{off, last}.Reader(mf), dest, CarveOptions{Atomic: true})
+	return err
+}
+
+// validateChunks checks that each chunk starts just after a delim in
+// mf, or at its start, and ends with one, or at its end, logging those
+// that don't
+func validateChunks(mf ReaderAt, chunks []Chunk, delim byte, logger *log.Logger) error {
+	size := int64(mf.Len())
+	var bad int
+	for _, c := range chunks {
+		s := c.Section
+		if s.off > 0 && mf.At(int(s.off-1)) != delim {
+			logger.Printf("invalid: chunk %d (%s) starts part way through a line at %d\n", c.Index, c.Name, s.off)
+			bad++
+		} else if s.end < size && s.end > s.off && mf.At(int(s.end-1)) != delim {
+			logger.Printf("invalid: chunk %d (%s) ends part way through a line at %d\n", c.Index, c.Name, s.end)
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d chunks are not on line boundaries", bad, len(chunks))
+	}
+	return nil
+}
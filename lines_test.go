@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSectionsByLines(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		data  string
+		lines int
+		want  int
+	}{
+		{"even", lines(1, 100), 10, 10},
+		{"remainder", lines(1, 105), 10, 11},
+		{"no trailing newline", lines(1, 9) + "ten", 5, 2},
+		{"more than there are", lines(1, 3), 10, 1},
+		{"one each", lines(1, 5), 1, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sections := sectionsOf(t, tc.data, Options{Lines: tc.lines})
+			checkCover(t, sections, int64(len(tc.data)))
+			checkLineEnds(t, tc.data, sections, '\n')
+			if len(sections) != tc.want {
+				t.Fatalf("got %d sections, want %d", len(sections), tc.want)
+			}
+			for i, s := range sections[:len(sections)-1] {
+				if n := strings.Count(tc.data[s.off:s.end], "\n"); n != tc.lines {
+					t.Errorf("section %d has %d lines, want %d", i, n, tc.lines)
+				}
+			}
+		})
+	}
+}
+
+func TestSectionsByDelimiter(t *testing.T) {
+	data := strings.Repeat("record\x00", 50)
+	sections := sectionsOf(t, data, Options{Size: 30, Delimiter: "\x00"})
+	checkCover(t, sections, int64(len(data)))
+	checkLineEnds(t, data, sections, 0)
+
+	sections = sectionsOf(t, data, Options{Lines: 7, Delimiter: "\x00"})
+	checkCover(t, sections, int64(len(data)))
+	if len(sections) != 8 {
+		t.Errorf("got %d sections of 7 records, want 8", len(sections))
+	}
+}
+
+func TestOverlapSections(t *testing.T) {
+	data := strings.Repeat("aaaaaaaaaa\n", 6)
+	for _, tc := range []struct {
+		overlap int64
+		offs    []int64
+	}{
+		// the line before is longer than the overlap
+		{5, []int64{0, 22, 44}},
+		{11, []int64{0, 11, 33}},
+		{21, []int64{0, 11, 33}},
+	} {
+		sections := sectionsOf(t, data, Options{Size: 22, Overlap: tc.overlap})
+		if len(sections) != len(tc.offs) {
+			t.Fatalf("overlap %d: got %d sections, want %d", tc.overlap, len(sections), len(tc.offs))
+		}
+		for i, s := range sections {
+			if s.off != tc.offs[i] {
+				t.Errorf("overlap %d: section %d starts at %d, want %d", tc.overlap, i, s.off, tc.offs[i])
+			}
+			if i > 0 && s.off <= sections[i-1].off {
+				t.Errorf("overlap %d: section %d swallows the one before", tc.overlap, i)
+			}
+		}
+	}
+}
+
+func TestMergeSmallTail(t *testing.T) {
+	data := lines(1, 10) + "x\n"
+	sections := sectionsOf(t, data, Options{Lines: 5, MinSize: 10})
+	checkCover(t, sections, int64(len(data)))
+	if len(sections) != 2 {
+		t.Errorf("got %d sections, want the small tail merged into 2", len(sections))
+	}
+	if sections = sectionsOf(t, "x\n", Options{Lines: 5, MinSize: 10}); len(sections) != 1 {
+		t.Errorf("got %d sections of a lone small one, want 1", len(sections))
+	}
+}
+
+func TestDropBlankTail(t *testing.T) {
+	data := lines(1, 10) + "\n\n \n"
+	sections := sectionsOf(t, data, Options{Lines: 10, DropBlankTail: true})
+	if len(sections) != 1 || sections[0].end != int64(len(lines(1, 10))) {
+		t.Errorf("got %v, want the blank tail dropped", sections)
+	}
+}
+
+func TestLineIter(t *testing.T) {
+	data := "one\ntwo\n\nfour"
+	var got []string
+	it := LineIter(NewBytesReaderAt([]byte(data)), 0)
+	for it.Next() {
+		start, end := it.Line()
+		got = append(got, data[start:end])
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one\n", "two\n", "\n", "four"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MergeOptions configure MergeWith
+type MergeOptions struct {
+	// Prefix of the chunk files, "part" by default
+	Prefix string
+
+	// Verify the chunks against their checksums before merging
+	Verify bool
+
+	// MetaDir holds the checksums if they aren't alongside the chunks
+	MetaDir string
+
+	// ChecksumAlgo is the algorithm of the checksums to verify,
+	// inferred from the checksum file found if empty
+	ChecksumAlgo string
+}
+
+// Merge concatenates the chunks of prefix in dir, in index order, into dest.
+// Padded chunks are cut back to their real sizes, as recorded in the report.
+//
+// With verify, the chunks are those listed in dir's checksum file and each
+// is checked against its checksum first, so nothing is written if any
+// chunk is missing or corrupt. Either way dest is written atomically,
+// so a failure part way through never leaves a partial output.
+func Merge(dir, prefix, dest string, verify bool) error {
+	return MergeWith(dir, dest, MergeOptions{Prefix: prefix, Verify: verify})
+}
+
+// MergeWith is Merge configured by opts. It fails without writing
+// anything if there are indexes missing between the first and last chunk,
+// or if the offsets in their names show the chunks don't cover the
+// source exactly.
+func MergeWith(dir, dest string, opts MergeOptions) error {
+	plan, err := PlanMerge(dir, opts)
+	if err != nil {
+		return err
+	}
+	if len(plan.Missing) > 0 {
+		return fmt.Errorf("chunks missing from %q: %s", dir, plan.missing())
+	}
+	_, err = CarveWith(&filesReader{names: plan.Names, sizes: plan.sizes}, dest, CarveOptions{Atomic: true})
+	return err
+}
+
+// MergePlan is what MergeWith would do
+type MergePlan struct {
+	// Names of the chunk files, in the order they would be merged
+	Names []string
+
+	// Size of the merged file
+	Size int64
+
+	// Missing indexes between the first chunk and the last
+	Missing []int
+
+	// real sizes of padded chunks
+	sizes map[string]int64
+}
+
+// missing lists the missing indexes
+func (p MergePlan) missing() string {
+	s := make([]string, len(p.Missing))
+	for i, idx := range p.Missing {
+		s[i] = strconv.Itoa(idx)
+	}
+	return strings.Join(s, ", ")
+}
+
+// PlanMerge works out what MergeWith would do without writing anything,
+// so that gaps or duplicates in a set of chunks show up before a long merge.
+// With opts.Verify the chunks are also checked against their checksums.
+func PlanMerge(dir string, opts MergeOptions) (MergePlan, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "part"
+	}
+	var names []string
+	if opts.Verify {
+		algo, sums, err := findSums(dir, opts.MetaDir, opts.ChecksumAlgo)
+		if err != nil {
+			return MergePlan{}, err
+		}
+		if err := verifySums(dir, algo, sums); err != nil {
+			return MergePlan{}, err
+		}
+		for _, e := range sums {
+			if _, ok := chunkIndex(e.name, prefix); ok {
+				names = append(names, filepath.Join(dir, e.name))
+			}
+		}
+	} else {
+		var err error
+		if names, err = filepath.Glob(filepath.Join(dir, prefix+"-*")); err != nil {
+			return MergePlan{}, err
+		}
+	}
+	names, indexes, err := sortChunks(names, prefix)
+	if err != nil {
+		return MergePlan{}, err
+	}
+	if len(names) == 0 {
+		return MergePlan{}, fmt.Errorf("no chunks of %q found in %q", prefix, dir)
+	}
+	sizes, err := paddedSizes(dir, opts.MetaDir)
+	if err != nil {
+		return MergePlan{}, err
+	}
+
+	if err := checkRanges(names, prefix); err != nil {
+		return MergePlan{}, err
+	}
+
+	plan := MergePlan{Names: names, sizes: sizes}
+	for i, name := range names {
+		size, ok := sizes[filepath.Base(name)]
+		if !ok {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return MergePlan{}, err
+			}
+			size = fi.Size()
+		}
+		plan.Size += size
+		if i > 0 {
+			for idx := indexes[i-1] + 1; idx < indexes[i]; idx++ {
+				plan.Missing = append(plan.Missing, idx)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// chunkIndex parses the index from a chunk filename
+func chunkIndex(name, prefix string) (int, bool) {
+	rest := strings.TrimPrefix(filepath.Base(name), prefix+"-")
+	if len(rest) == len(filepath.Base(name)) {
+		return 0, false
+	}
+	var idx int
+	if _, err := fmt.Sscanf(rest, "%d", &idx); err != nil {
+		return 0, false
+	}
+	return idx, true
+}
+
+// chunkRange parses the offsets of the section held by a chunk from its
+// filename, which only the default naming records
+func chunkRange(name, prefix string) (Section, bool) {
+	rest := strings.TrimPrefix(filepath.Base(name), prefix+"-")
+	var idx int
+	var s Section
+	if _, err := fmt.Sscanf(rest, "%d-%d-%d", &idx, &s.off, &s.end); err != nil {
+		return Section{}, false
+	}
+	return s, true
+}
+
+// checkRanges fails if the sections named by consecutive chunks leave a
+// gap or overlap, as when chunks of different runs are mixed together.
+// Chunks named without offsets are taken on trust.
+func checkRanges(names []string, prefix string) error {
+	for i := 1; i < len(names); i++ {
+		prev, ok := chunkRange(names[i-1], prefix)
+		if !ok {
+			continue
+		}
+		s, ok := chunkRange(names[i], prefix)
+		if !ok {
+			continue
+		}
+		switch {
+		case s.off > prev.end:
+			return fmt.Errorf("gap between %q and %q: bytes %d to %d are missing", names[i-1], names[i], prev.end, s.off)
+		case s.off < prev.end:
+			return fmt.Errorf("%q and %q overlap from byte %d to %d", names[i-1], names[i], s.off, prev.end)
+		}
+	}
+	return nil
+}
+
+// sortChunks orders chunk filenames by index, ignoring other files
+// and rejecting duplicate indexes, returning the indexes too
+func sortChunks(names []string, prefix string) ([]string, []int, error) {
+	type indexed struct {
+		idx  int
+		name string
+	}
+	var list []indexed
+	for _, name := range names {
+		if idx, ok := chunkIndex(name, prefix); ok {
+			list = append(list, indexed{idx, name})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].idx < list[j].idx
+	})
+	sorted := make([]string, len(list))
+	indexes := make([]int, len(list))
+	for i, x := range list {
+		if i > 0 && x.idx == list[i-1].idx {
+			return nil, nil, fmt.Errorf("duplicate chunk index %d: %q and %q", x.idx, list[i-1].name, x.name)
+		}
+		sorted[i], indexes[i] = x.name, x.idx
+	}
+	return sorted, indexes, nil
+}
+
+// filesReader reads a list of files one after the other,
+// only holding one open at a time. Files with an entry in sizes
+// are only read that far, leaving out their padding.
+type filesReader struct {
+	names []string
+	sizes map[string]int64
+	f     *os.File
+	r     io.Reader
+}
+
+func (r *filesReader) Read(b []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.f, r.r = f, f
+			if size, ok := r.sizes[filepath.Base(r.names[0])]; ok {
+				r.r = io.LimitReader(f, size)
+			}
+			r.names = r.names[1:]
+		}
+		n, err := r.r.Read(b)
+		if err != nil {
+			r.f.Close()
+			r.f = nil
+			if err == io.EOF {
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkMerge merges the chunks in dir and fails unless they give want
+func checkMerge(t *testing.T, dir string, verify bool, want string) {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), "merged")
+	if err := Merge(dir, "part", dest, verify); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("merged %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestChunkFileFromMerge(t *testing.T) {
+	src := writeSource(t, lines(1, 100))
+	dir := filepath.Join(t.TempDir(), "chunks")
+	opts := quiet(Options{Size: 200, Checksums: true})
+	next, err := ChunkFileFrom(src, dir, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(src, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last line is still being written
+	fmt.Fprint(f, lines(101, 150)+"line 1")
+	f.Close()
+	if next, err = ChunkFileFrom(src, dir, next, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := lines(1, 150)
+	if next != int64(len(want)) {
+		t.Fatalf("next offset is %d, want %d", next, len(want))
+	}
+	checkMerge(t, dir, false, want)
+	checkMerge(t, dir, true, want)
+}
+
+func TestMergeRoundTrip(t *testing.T) {
+	data := lines(1, 3000) + "tail"
+	src := writeSource(t, data)
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"size", Options{Size: 1000}},
+		{"lines", Options{Lines: 7}},
+		{"parts", Options{MaxChunks: 9, Size: math.MaxInt64}},
+		{"padded", Options{Size: 1000, PadTo: 1100, PadByte: '#'}},
+		{"checksums", Options{Size: 4000, Checksums: true, ChecksumAlgo: "crc32"}},
+		{"indexed names", Options{Size: 1000, NameTemplate: "indexed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "chunks")
+			if _, err := ChunkFileWith(src, dir, quiet(tc.opts)); err != nil {
+				t.Fatal(err)
+			}
+			checkMerge(t, dir, tc.opts.Checksums, data)
+		})
+	}
+}
+
+func TestMergePaddedStream(t *testing.T) {
+	data := lines(1, 1000)
+	dir := filepath.Join(t.TempDir(), "chunks")
+	opts := quiet(Options{Size: 500, PadTo: 600})
+	if _, err := NewChunker(opts).ChunkStreamed(context.Background(), strings.NewReader(data), dir); err != nil {
+		t.Fatal(err)
+	}
+	checkMerge(t, dir, false, data)
+}
+
+func TestMergeCompressed(t *testing.T) {
+	data := lines(1, 2000)
+	dir := filepath.Join(t.TempDir(), "chunks")
+	if _, err := ChunkFileWith(writeSource(t, data), dir, quiet(Options{Size: 1000, Compress: true})); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "merged.gz")
+	if err := Merge(dir, "part", dest, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || string(got) != data {
+		t.Fatalf("merged chunks gunzip to %d bytes, want %d: %v", len(got), len(data), err)
+	}
+}
+
+func TestMergeVerifyCorrupt(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "chunks")
+	res, err := ChunkFileWith(writeSource(t, lines(1, 1000)), dir, quiet(Options{Size: 1000, Checksums: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim := res.Chunks[3].Name
+	data, _ := os.ReadFile(victim)
+	data[10] ^= 1
+	if err := os.WriteFile(victim, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "merged")
+	if err := Merge(dir, "part", dest, true); err == nil {
+		t.Fatal("merged a corrupt chunk")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("a partial merge was left behind: %v", err)
+	}
+	if err := Verify(dir); err == nil {
+		t.Error("verified a corrupt chunk")
+	}
+}
+
+func TestPlanMergeGap(t *testing.T) {
+	data := lines(1, 1000)
+	dir := filepath.Join(t.TempDir(), "chunks")
+	res, err := ChunkFileWith(writeSource(t, data), dir, quiet(Options{Size: 1000, NameTemplate: "indexed"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanMerge(dir, MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Names) != len(res.Chunks) || plan.Size != int64(len(data)) || len(plan.Missing) != 0 {
+		t.Fatalf("planned %d chunks of %d bytes missing %v", len(plan.Names), plan.Size, plan.Missing)
+	}
+
+	os.Remove(res.Chunks[2].Name)
+	os.Remove(res.Chunks[4].Name)
+	if plan, err = PlanMerge(dir, MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Missing) != 2 || plan.Missing[0] != 2 || plan.Missing[1] != 4 {
+		t.Errorf("got missing %v, want [2 4]", plan.Missing)
+	}
+	if err := Merge(dir, "part", filepath.Join(t.TempDir(), "merged"), false); err == nil {
+		t.Error("merged chunks with a gap")
+	}
+}
+
+func TestMergeMixedRuns(t *testing.T) {
+	src := writeSource(t, lines(1, 1000))
+	dir := filepath.Join(t.TempDir(), "chunks")
+	for _, size := range []int64{1000, 1500} {
+		if _, err := ChunkFileWith(src, dir, quiet(Options{Size: size})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Merge(dir, "part", filepath.Join(t.TempDir(), "merged"), false); err == nil {
+		t.Error("merged the overlapping chunks of two runs")
+	}
+}
+
+func TestIndexedRoundTrip(t *testing.T) {
+	data := "skip me\n" + lines(1, 500)
+	src := writeSource(t, data)
+	dest := filepath.Join(t.TempDir(), "all.txt")
+	if err := IndexFileWith(src, dest, quiet(Options{Lines: 50, Skip: 1})); err != nil {
+		t.Fatal(err)
+	}
+	x, err := OpenIndexed(dest, dest+IndexExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if x.Len() != 10 {
+		t.Fatalf("indexed %d chunks, want 10", x.Len())
+	}
+	var b bytes.Buffer
+	for i := 0; i < x.Len(); i++ {
+		io.Copy(&b, x.Reader(i))
+	}
+	if b.String() != lines(1, 500) {
+		t.Error("indexed chunks don't read back as the source")
+	}
+}
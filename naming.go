@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NameData are the fields available to a chunk name template,
+// e.g. "{{.Src}}-{{printf \"%05d\" .Index}}{{.Ext}}"
+type NameData struct {
+	Prefix string    // Options.Prefix
+	Index  int       // index of the chunk
+	Off    int64     // offset of the chunk in the source
+	End    int64     // offset just past the end of the chunk
+	Src    string    // source filename, less its directory and extension, if any
+	Ext    string    // source extension, including the dot
+	Date   time.Time // when chunking started
+}
+
+// NameSchemes are named templates that Options.NameTemplate can be set
+// to instead of a template of its own
+var NameSchemes = map[string]string{
+	// the default naming
+	"offsets": `{{.Prefix}}-{{printf "%04d" .Index}}-{{printf "%012d" .Off}}-{{printf "%012d" .End}}{{.Ext}}`,
+	// e.g. part-0001.csv
+	"indexed": `{{.Prefix}}-{{printf "%04d" .Index}}{{.Ext}}`,
+	// e.g. part-00000001.csv, which sorts by name beyond 10000 chunks
+	"padded": `{{.Prefix}}-{{printf "%08d" .Index}}{{.Ext}}`,
+}
+
+// namer returns the filename for each section
+type namer func(i int, s Section) (string, error)
+
+// newNamer returns a namer for chunks of source in dir, using the
+// default naming unless opts has a template or names a scheme. The
+// template is checked up front so that a bad one fails before anything
+// is written, as is one that would give different sections the same name.
+func newNamer(source, dir string, opts Options) (namer, error) {
+	ext := opts.Ext
+	if ext == "" {
+		ext = sourceExt(source)
+	}
+	var gz string
+	if opts.Compress {
+		gz = gzipExt
+	}
+	if opts.NameTemplate == "" {
+		return func(i int, s Section) (string, error) {
+			return fmt.Sprintf(fileTemplate, dir, opts.Prefix, i, s.off, s.end, ext) + gz, nil
+		}, nil
+	}
+
+	text := opts.NameTemplate
+	if scheme, ok := NameSchemes[text]; ok {
+		text = scheme
+	}
+	t, err := template.New("name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	data := NameData{
+		Prefix: opts.Prefix,
+		Ext:    ext,
+		Date:   time.Now(),
+	}
+	if source != "" {
+		data.Src = strings.TrimSuffix(path.Base(source), sourceExt(source))
+	}
+	// unknown fields only show up when executed
+	var first, second bytes.Buffer
+	if err := t.Execute(&first, data); err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	next := data
+	next.Index, next.Off, next.End = 1, 1, 2
+	if err := t.Execute(&second, next); err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	if first.String() == second.String() {
+		return nil, fmt.Errorf("name template %q gives every chunk the same name, it needs .Index, .Off or .End", opts.NameTemplate)
+	}
+
+	return func(i int, s Section) (string, error) {
+		d := data
+		d.Index, d.Off, d.End = i, s.off, s.end
+		var b bytes.Buffer
+		if err := t.Execute(&b, d); err != nil {
+			return "", err
+		}
+		return path.Join(dir, b.String()) + gz, nil
+	}, nil
+}
+
+// sourceExt is the extension of source, if any. Unlike path.Ext,
+// a dot file such as ".bashrc" is a name rather than an extension.
+func sourceExt(source string) string {
+	base := path.Base(source)
+	ext := path.Ext(base)
+	if ext == base {
+		return ""
+	}
+	return ext
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSearchPage is how much is read at a time when searching
+// for the newline to end a section on
+const DefaultSearchPage = 4096
+
+// MaxBufferMemory caps the write buffers of all the workers together,
+// unless Options.BufferSize is set
+const MaxBufferMemory = 256 << 20
+
+// minBufferSize is as small as a scaled down write buffer gets
+const minBufferSize = 64 << 10
+
+// Options configure how a file is chunked.
+// Zero values are replaced by the defaults below.
+type Options struct {
+	// Prefix of chunked files, "part" by default
+	Prefix string
+
+	// NameTemplate, if set, is a text/template for chunk filenames
+	// with the fields of NameData, or the name of one of NameSchemes,
+	// replacing the default naming of prefix-index-offset-end.ext
+	NameTemplate string
+
+	// Ext is the extension of chunk files, including the dot,
+	// that of the source by default
+	Ext string
+
+	// StartIndex is the index of the first chunk, so that several runs
+	// can continue a single numbered sequence
+	StartIndex int
+
+	// Size is the target size of each chunk, 1GB by default
+	Size int64
+
+	// MaxChunks, if set, splits into at most MaxChunks chunks of about
+	// the same size, unless that would make them bigger than Size. Size
+	// takes precedence, so a source over MaxChunks times Size is split
+	// into more chunks of Size instead.
+	MaxChunks int
+
+	// Workers is the number of simultaneous carves, GOMAXPROCS by default
+	Workers int
+
+	// BufferSize is the write buffer of each carve. By default it is
+	// DefaultBufferSize, cut down when there are enough Workers that
+	// their buffers would come to more than MaxBufferMemory.
+	BufferSize int
+
+	// SearchPage is how much to read at a time when looking for the
+	// newline to end a section on, DefaultSearchPage by default.
+	// Sections are ended on the last newline within a page of the
+	// target size, so data with very long lines benefits from a bigger page.
+	SearchPage int64
+
+	// OversizeFactor is how many times larger than Size a section may
+	// grow, because of long lines, before it is warned about, 2 by default
+	OversizeFactor float64
+
+	// KeepGoing carves the rest of the chunks after one fails, rather
+	// than cancelling them, and returns an error listing every failure
+	KeepGoing bool
+
+	// Sink, if set, creates what each chunk is written to in place of
+	// a file in the output directory. The chunks are named as usual, but
+	// metadata such as checksums is still written to files, so the
+	// directory is only created for that. It can't be used with a
+	// streamed source.
+	Sink SinkFactory
+
+	// Resume keeps any chunk already in the output directory with the
+	// name and size it would be written with, as left by an interrupted
+	// run, carving only the rest. Compressed chunks are kept by name
+	// alone, which is safe as chunks only appear once complete. It
+	// doesn't apply to streamed sources, whose chunks aren't named
+	// until they have been read.
+	Resume bool
+
+	// Validate checks, once carved, that every chunk starts and ends on
+	// a line boundary in the source, as a safety net for the splitting.
+	// Each chunk that doesn't is logged and the run fails.
+	Validate bool
+
+	// StrictSize makes an oversize section an error rather than a warning
+	StrictSize bool
+
+	// CSV splits between whole records, so that a newline inside a
+	// quoted field never ends a chunk. It works with Size or Lines,
+	// counting records rather than lines, but reads every byte to
+	// follow the quoting.
+	CSV bool
+
+	// Overlap, if set, starts each chunk after the first up to this many
+	// bytes before the end of the one before, at the start of a line,
+	// for processing with a window of context. The chunks then no
+	// longer partition the source, so they can't be merged back. It
+	// must be less than Size.
+	Overlap int64
+
+	// MinSize, if set, folds a final section smaller than this into the
+	// one before it, rather than writing a tiny last chunk
+	MinSize int64
+
+	// DropBlankTail leaves out a final section holding only whitespace,
+	// such as the trailing newlines of a file, rather than writing a
+	// chunk that's effectively empty
+	DropBlankTail bool
+
+	// Key, if set, splits the source wherever the key of its lines
+	// changes instead of by Size, giving a chunk per key. The lines
+	// must be sorted by key, though in any order, as with ChunksByKeyChange.
+	Key KeyFunc
+
+	// Lines, if set, splits the source every Lines lines instead of by Size
+	Lines int
+
+	// Delimiter is the byte that ends each record, "\n" by default,
+	// e.g. "\x00" for the output of find -print0. Chunks end just past
+	// one, and wherever lines are spoken of it is records it delimits.
+	Delimiter string
+
+	// Skip is the number of lines to skip from the beginning of the source,
+	// e.g. a header. The skipped lines are dropped before the source is
+	// split, so with Lines every chunk holds whole lines of data.
+	Skip int
+
+	// SkipUntil, if set, also skips the lines before the first one that
+	// it matches, such as a preamble of varying length. It is an error
+	// for no line to match.
+	SkipUntil *regexp.Regexp
+
+	// Header repeats the first line of the source, such as a CSV header,
+	// at the start of every chunk that doesn't already begin with it.
+	// It is always the first line, even when Skip drops it from the
+	// data, and chunks by size are cut that much shorter so that they
+	// still come out at about Size.
+	Header bool
+
+	// GzipSource decompresses the source, which is assumed for one named
+	// ".gz". A compressed stream can't be mapped, so it is read through
+	// once, chunking by Size only, and the chunks are written one at a
+	// time. Offsets are of the decompressed data.
+	GzipSource bool
+
+	// Incomplete is what to do with a final record of a streamed source
+	// that has no delimiter, such as a line still being written to a
+	// file being tailed. Under HoldIncomplete it is left out of the
+	// chunks and returned in Result.Incomplete. Only streamed sources
+	// can hold one back.
+	Incomplete IncompletePolicy
+
+	// Logger receives warnings and a summary of each run,
+	// the standard logger by default
+	Logger *log.Logger
+
+	// Verbose also logs each section as it is found
+	Verbose bool
+
+	// PerChunkTimeout, if set, aborts any chunk that takes longer
+	// than this to carve, failing the job with a timeout error. A read
+	// or write already blocked, such as on a hung disk, can't be
+	// interrupted, so the chunk only fails once it returns, when a chunk
+	// that was completed too late is removed.
+	PerChunkTimeout time.Duration
+
+	// PadTo, if set, pads every chunk with PadByte to PadTo bytes, for
+	// storage that wants fixed size blocks. Size must be small enough
+	// that no chunk is longer. A ReportFile is always written with
+	// padding, whatever the source, as it records the real sizes that
+	// Merge strips it to. Chunks appended by ChunkFileFrom can't be padded.
+	PadTo   int64
+	PadByte byte
+
+	// Compress gzips each chunk, adding ".gz" to its name. Checksums
+	// are of the compressed files, and as gzip streams can be joined,
+	// merging the chunks gives the source gzipped. It can't be combined
+	// with PadTo.
+	Compress bool
+
+	// Preallocate reserves the disk for each chunk before writing it
+	Preallocate bool
+
+	// Checksums writes a SHA256SUMS file of the chunks
+	Checksums bool
+
+	// ChecksumAlgo is the algorithm for Checksums, DefaultChecksumAlgo
+	// by default, or "sha512", "sha1" or "md5", each written to the file
+	// its *sum(1) tool would check, e.g. MD5SUMS, or "crc32" to CRC32SUMS
+	ChecksumAlgo string
+
+	// WriteReport writes a ReportFile of the options, the source and
+	// the chunks, even if chunking fails part way
+	WriteReport bool
+
+	// Progress, if set, is called as each chunk is completed. Calls are
+	// serialized, so the counts only ever go up, but may come from any
+	// goroutine and hold up the others while they run.
+	Progress func(Progress)
+
+	// MetaDir is where metadata such as SHA256SUMS is written, so the
+	// output directory holds nothing but chunks. It defaults to the
+	// output directory, and "-" means stdout.
+	MetaDir string
+
+	// CompressMeta gzips the checksums and report, adding ".gz" to their
+	// names, so that they can be archived alongside compressed chunks.
+	// Verify and Merge read either.
+	CompressMeta bool
+
+	// RemoveSource deletes the source file, but only once every
+	// chunk has been written successfully
+	RemoveSource bool
+
+	// ErasePasses, if set, securely erases the source once every chunk
+	// has been written, rather than simply removing it (see SecureErase),
+	// overwriting it with ErasePattern repeated if set, else random data
+	ErasePasses  int
+	ErasePattern []byte
+}
+
+func (o Options) withDefaults() Options {
+	if o.Delimiter == "" {
+		o.Delimiter = "\n"
+	}
+	if o.Prefix == "" {
+		o.Prefix = "part"
+	}
+	if o.Size <= 0 {
+		o.Size = 1 << 30
+	}
+	if o.SearchPage <= 0 {
+		o.SearchPage = DefaultSearchPage
+	}
+	if o.OversizeFactor <= 0 {
+		o.OversizeFactor = 2
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = DefaultBufferSize
+		if o.BufferSize*o.Workers > MaxBufferMemory {
+			o.BufferSize = MaxBufferMemory / o.Workers
+		}
+		if o.BufferSize < minBufferSize {
+			o.BufferSize = minBufferSize
+		}
+	}
+	return o
+}
+
+// gzipped reports whether src is to be decompressed as it is read,
+// and so can't be mapped
+func (o Options) gzipped(src string) bool {
+	return o.GzipSource || strings.HasSuffix(src, gzipExt)
+}
+
+// delim is the record delimiter
+func (o Options) delim() byte {
+	if o.Delimiter == "" {
+		return '\n'
+	}
+	return o.Delimiter[0]
+}
+
+// debugf logs to the Logger only when Verbose
+func (o Options) debugf(format string, args ...interface{}) {
+	if o.Verbose {
+		o.Logger.Printf(format, args...)
+	}
+}
+
+// workersValue is a flag.Value for Options.Workers, taking either
+// a number of workers or a percentage of the CPUs, e.g. "50%"
+type workersValue struct {
+	n *int
+}
+
+func (w workersValue) String() string {
+	if w.n == nil {
+		return ""
+	}
+	return strconv.Itoa(*w.n)
+}
+
+func (w workersValue) Set(s string) error {
+	n, err := parseWorkers(s, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+	*w.n = n
+	return nil
+}
+
+// parseWorkers parses a number of workers, or a percentage of cpus
+// which is at least 1
+func parseWorkers(s string, cpus int) (int, error) {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct < 0 {
+			return 0, fmt.Errorf("invalid percentage of CPUs %q", s)
+		}
+		n := int(float64(cpus) * pct / 100)
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid number of workers %q", s)
+	}
+	return n, nil
+}
+
+// parseDelim parses a delimiter given as a byte or an escape
+// sequence such as \0, \t or \x1e
+func parseDelim(s string) (string, error) {
+	if s == `\0` {
+		return "\x00", nil
+	}
+	if len(s) == 1 {
+		return s, nil
+	}
+	r, _, tail, err := strconv.UnquoteChar(s, '\'')
+	if err != nil || tail != "" || r > 0xff {
+		return "", fmt.Errorf("invalid delimiter %q, it must be a single byte", s)
+	}
+	return string([]byte{byte(r)}), nil
+}
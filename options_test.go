@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseWorkers(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int
+	}{
+		{"4", 4},
+		{"50%", 4},
+		{"200%", 16},
+		{"0%", 1},
+		{"12.5%", 1},
+	} {
+		got, err := parseWorkers(tc.s, 8)
+		if err != nil || got != tc.want {
+			t.Errorf("parseWorkers(%q) = %d, %v, want %d", tc.s, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"0", "-1", "x", "-5%", "%"} {
+		if _, err := parseWorkers(s, 8); err == nil {
+			t.Errorf("parseWorkers(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestBufferSizeScaled(t *testing.T) {
+	for _, tc := range []struct {
+		workers int
+		want    int
+	}{
+		{1, DefaultBufferSize},
+		{16, DefaultBufferSize},
+		{64, MaxBufferMemory / 64},
+		{1 << 16, minBufferSize},
+	} {
+		if got := (Options{Workers: tc.workers}).withDefaults().BufferSize; got != tc.want {
+			t.Errorf("%d workers got a %d byte buffer, want %d", tc.workers, got, tc.want)
+		}
+	}
+}
+
+func TestParseDelim(t *testing.T) {
+	for s, want := range map[string]string{";": ";", `\0`: "\x00", `\t`: "\t", `\x1e`: "\x1e"} {
+		if got, err := parseDelim(s); err != nil || got != want {
+			t.Errorf("parseDelim(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := parseDelim("ab"); err == nil {
+		t.Error("parseDelim of two bytes succeeded")
+	}
+}
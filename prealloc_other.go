@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// preallocate is a no-op where fallocate isn't available, as truncating
+// up front would only make a sparse file
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
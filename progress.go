@@ -0,0 +1,42 @@
+package main
+
+// Progress is passed to Options.Progress as each chunk is completed
+type Progress struct {
+	// Last is the chunk just completed. Chunks complete in any order
+	// when carved concurrently, so its index may be below one reported
+	// before.
+	Last Chunk
+
+	// Chunks is the number of chunks completed so far
+	Chunks int
+
+	// Sections is the number of sections found so far, which is the
+	// final count once the source has been scanned. FileChunks is given
+	// them all, so it knows the count from the start.
+	Sections int
+
+	// Bytes is the number of the source carved into the completed
+	// chunks, not counting the header repeated in each
+	Bytes int64
+
+	// Total is the number of bytes to be carved
+	Total int64
+}
+
+// ByteFraction is the fraction of the bytes carved so far, which moves
+// more smoothly than SectionFraction when chunk sizes vary
+func (p Progress) ByteFraction() float64 {
+	if p.Total <= 0 {
+		return 1
+	}
+	return float64(p.Bytes) / float64(p.Total)
+}
+
+// SectionFraction is the fraction of the sections found so far that
+// have been carved
+func (p Progress) SectionFraction() float64 {
+	if p.Sections <= 0 {
+		return 1
+	}
+	return float64(p.Chunks) / float64(p.Sections)
+}
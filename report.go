@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReportFile names the report written alongside the chunks
+// when Options.WriteReport is set
+const ReportFile = "report.json"
+
+// report records how a source was chunked and what came of it
+type report struct {
+	Source   string        `json:"source"`
+	Size     int64         `json:"size"`
+	ModTime  time.Time     `json:"mod_time"`
+	Options  reportOptions `json:"options"`
+	Chunks   []reportChunk `json:"chunks"`
+	Skipped  int64         `json:"skipped"`
+	Bytes    int64         `json:"bytes"`
+	Duration string        `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// reportOptions are the Options that decide the chunks
+type reportOptions struct {
+	Size         int64  `json:"size"`
+	Lines        int    `json:"lines,omitempty"`
+	MaxChunks    int    `json:"max_chunks,omitempty"`
+	Delimiter    string `json:"delimiter,omitempty"`
+	Skip         int    `json:"skip,omitempty"`
+	SkipUntil    string `json:"skip_until,omitempty"`
+	Prefix       string `json:"prefix"`
+	NameTemplate string `json:"name_template,omitempty"`
+	Ext          string `json:"ext,omitempty"`
+	StartIndex   int    `json:"start_index,omitempty"`
+	PadTo        int64  `json:"pad_to,omitempty"`
+	Compress     bool   `json:"compress,omitempty"`
+	ChecksumAlgo string `json:"checksum_algo,omitempty"`
+	Workers      int    `json:"workers"`
+}
+
+type reportChunk struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Off   int64  `json:"off"`
+	End   int64  `json:"end"`
+	Size  int64  `json:"size"`
+	Sum   string `json:"checksum,omitempty"`
+}
+
+// reportRun writes the report of a run if opts asks for one or pads the
+// chunks, as Merge needs the real sizes it records, returning err or
+// else the failure to write it
+func reportRun(dir, source string, fi fs.FileInfo, opts Options, res Result, err error) error {
+	if !opts.WriteReport && opts.PadTo == 0 {
+		return err
+	}
+	if rerr := writeReport(dir, source, fi, opts, res, err); rerr != nil && err == nil {
+		err = fmt.Errorf("writing report: %w", rerr)
+	}
+	return err
+}
+
+// writeReport writes the report of chunking source, described by fi,
+// to dir or opts.MetaDir. Only the chunks that were written are listed,
+// so after a failure it shows how far the run got. A streamed source
+// has no fi, nor a name unless it was decompressed from a file.
+func writeReport(dir, source string, fi fs.FileInfo, opts Options, res Result, err error) error {
+	r := report{
+		Source: source,
+		Options: reportOptions{
+			Size:         opts.Size,
+			Lines:        opts.Lines,
+			MaxChunks:    opts.MaxChunks,
+			Skip:         opts.Skip,
+			Prefix:       opts.Prefix,
+			NameTemplate: opts.NameTemplate,
+			Ext:          opts.Ext,
+			StartIndex:   opts.StartIndex,
+			PadTo:        opts.PadTo,
+			Compress:     opts.Compress,
+			Workers:      opts.Workers,
+		},
+		Chunks:   make([]reportChunk, len(res.Chunks)),
+		Skipped:  res.Skipped,
+		Bytes:    res.Bytes,
+		Duration: res.Duration.String(),
+	}
+	if fi != nil {
+		r.Size, r.ModTime = fi.Size(), fi.ModTime()
+	}
+	if opts.Checksums {
+		r.Options.ChecksumAlgo = opts.ChecksumAlgo
+		if r.Options.ChecksumAlgo == "" {
+			r.Options.ChecksumAlgo = DefaultChecksumAlgo
+		}
+	}
+	if opts.delim() != '\n' {
+		r.Options.Delimiter = opts.Delimiter
+	}
+	if opts.SkipUntil != nil {
+		r.Options.SkipUntil = opts.SkipUntil.String()
+	}
+	for i, c := range res.Chunks {
+		r.Chunks[i] = reportChunk{
+			Index: c.Index,
+			Name:  c.Name,
+			Off:   c.Section.off,
+			End:   c.Section.end,
+			Size:  c.Size,
+			Sum:   hex.EncodeToString(c.Sum),
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	f, err := createMeta(dir, opts.MetaDir, ReportFile, opts.CompressMeta)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// paddedSizes reads the real sizes of padded chunks, by filename, from
+// the report in dir or metaDir. There are none if the chunks weren't
+// padded or there is no report.
+func paddedSizes(dir, metaDir string) (map[string]int64, error) {
+	f, _, err := openMeta(dir, metaDir, ReportFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r report
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ReportFile, err)
+	}
+	if r.Options.PadTo == 0 {
+		return nil, nil
+	}
+	sizes := make(map[string]int64, len(r.Chunks))
+	for _, c := range r.Chunks {
+		sizes[filepath.Base(c.Name)] = c.Size
+	}
+	return sizes, nil
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"path"
-	"runtime"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/exp/mmap"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -25,80 +35,577 @@ const fileTemplate = "%s/%s-%04d-%012d-%012d%s"
 
 func main() {
 	var (
-		size    int64 = 1 << 30
-		skip    int
-		workers = runtime.GOMAXPROCS(0)
-		prefix  = "part"
+		opts         = Options{}.withDefaults()
+		quiet        bool
+		index        bool
+		countLines   bool
+		files        string
+		merge        bool
+		verify       bool
+		extract      string
+		extractBytes string
+		recursive    bool
+		keyField     int
+		dryRun       bool
+		spool        bool
+		parts        int
+		keySep       = "\t"
+		snap         bool
+		from         int64 = -1
+		hold         bool
 	)
+	// left to be scaled to the workers once -workers is known
+	opts.BufferSize = 0
 
-	flag.Int64Var(&size, "size", size, "file size for each chunk")
-	flag.IntVar(&skip, "skip", skip, "skip # lines from beginning of file")
-	flag.IntVar(&workers, "workers", workers, "number of simultaneous workers")
-	flag.StringVar(&prefix, "prefix", prefix, "prefix of chunked files")
+	flag.Int64Var(&opts.Size, "size", opts.Size, "file size for each chunk")
+	flag.IntVar(&opts.Lines, "lines", opts.Lines, "split every # lines instead of by size")
+	flag.IntVar(&parts, "parts", parts, "split into # chunks of about the same size, however big")
+	flag.IntVar(&opts.MaxChunks, "chunks", opts.MaxChunks, "split into at most # chunks, each no bigger than -size")
+	flag.IntVar(&keyField, "key-field", keyField, "chunk wherever this field, counting from 1, changes value in input sorted by it")
+	flag.StringVar(&keySep, "key-sep", keySep, "field separator for -key-field")
+	flag.Int64Var(&opts.SearchPage, "page", opts.SearchPage, "bytes to search at a time for the newline ending each chunk")
+	flag.BoolVar(&opts.KeepGoing, "keep-going", opts.KeepGoing, "carve every chunk possible after one fails, reporting all the failures")
+	flag.BoolVar(&opts.Resume, "resume", opts.Resume, "keep chunks already written with the right size, carving only the rest")
+	flag.BoolVar(&opts.Validate, "validate", opts.Validate, "check every chunk starts and ends on a line boundary, failing if not")
+	flag.BoolVar(&opts.StrictSize, "strict", opts.StrictSize, "fail rather than warn when a long line makes a chunk over twice the size")
+	flag.BoolVar(&opts.CSV, "csv", opts.CSV, "split between whole CSV records, never within a quoted field")
+	flag.Int64Var(&opts.Overlap, "overlap", opts.Overlap, "start each chunk up to # bytes, in whole lines, before the end of the one before")
+	flag.Int64Var(&opts.MinSize, "min-size", opts.MinSize, "fold a last chunk smaller than this into the one before it")
+	flag.BoolVar(&opts.DropBlankTail, "drop-blank", opts.DropBlankTail, "don't write a final chunk that is only whitespace")
+	flag.Func("delim", "byte ending each record instead of newline, e.g. '\\0' or ';'", func(s string) error {
+		d, err := parseDelim(s)
+		opts.Delimiter = d
+		return err
+	})
+	flag.IntVar(&opts.Skip, "skip", opts.Skip, "skip # lines from beginning of file")
+	flag.Func("skip-until", "skip lines until one matching this regexp", func(s string) (err error) {
+		opts.SkipUntil, err = regexp.Compile(s)
+		return err
+	})
+	flag.BoolVar(&opts.Header, "header", opts.Header, "repeat the first line of the source at the start of every chunk")
+	flag.BoolVar(&opts.GzipSource, "gzip", opts.GzipSource, "decompress the source as it is read, assumed for a .gz src-file")
+	flag.Var(workersValue{&opts.Workers}, "workers", "number of simultaneous workers, or a percentage of the CPUs such as 50%")
+	flag.IntVar(&opts.BufferSize, "buffer", opts.BufferSize, "write buffer size of each worker, by default 16MB unless that comes to over 256MB for all of them")
+	flag.StringVar(&opts.Prefix, "prefix", opts.Prefix, "prefix of chunked files")
+	flag.StringVar(&opts.Ext, "ext", opts.Ext, "extension of chunked files, that of the source by default")
+	flag.IntVar(&opts.StartIndex, "start", opts.StartIndex, "index of the first chunk, to continue the numbering of a previous run")
+	flag.StringVar(&opts.NameTemplate, "name", opts.NameTemplate, "text/template for chunk names, with fields .Prefix .Index .Off .End .Src .Ext .Date, or a scheme: offsets, indexed or padded")
+	flag.Int64Var(&from, "from", from, "only chunk complete lines appended since this offset, numbering on from the chunks in dest-dir, printing the next offset")
+	flag.BoolVar(&recursive, "recursive", recursive, "chunk every file under src-dir into matching subdirectories of dest-dir")
+	flag.StringVar(&files, "files", files, "chunk each file listed in this file into its own subdirectory of dest-dir")
+	flag.BoolVar(&hold, "hold", hold, "with a src-file of -, leave out a final line without a newline, as when tailing a file still being written")
+	flag.BoolVar(&spool, "spool", spool, "with a src-file of -, copy stdin to a temporary file in dest-dir and chunk that in parallel rather than as it is read")
+	flag.BoolVar(&countLines, "count", countLines, "list the chunks that would be written, as tab separated index, size and line count, without writing them")
+	flag.BoolVar(&index, "index", index, "write a single file and an index of chunk offsets instead of chunks")
+	flag.BoolVar(&opts.RemoveSource, "remove", opts.RemoveSource, "remove the source file once every chunk is written")
+	flag.IntVar(&opts.ErasePasses, "erase", opts.ErasePasses, "overwrite the source # times then remove it once every chunk is written")
+	flag.Func("erase-pattern", "bytes in hex to -erase with, e.g. 00 or ff00, rather than random data", func(s string) (err error) {
+		opts.ErasePattern, err = hex.DecodeString(s)
+		return err
+	})
+	flag.Int64Var(&opts.PadTo, "pad", opts.PadTo, "pad every chunk to this many bytes, writing a "+ReportFile+" for -merge to strip it")
+	flag.Func("pad-byte", "byte to pad with, 0 by default", func(s string) error {
+		b, err := strconv.ParseUint(s, 0, 8)
+		opts.PadByte = byte(b)
+		return err
+	})
+	flag.BoolVar(&opts.Compress, "compress", opts.Compress, "gzip each chunk, adding .gz to its name")
+	flag.BoolVar(&opts.Preallocate, "prealloc", opts.Preallocate, "reserve the disk for each chunk before writing it")
+	flag.BoolVar(&opts.Checksums, "checksum", opts.Checksums, "write a "+SumsFile+" file of the chunks")
+	flag.StringVar(&opts.ChecksumAlgo, "checksum-algo", opts.ChecksumAlgo, "checksum algorithm: sha256 (default), sha512, sha1, md5 or crc32, each written to its own *SUMS file")
+	flag.BoolVar(&opts.CompressMeta, "gzip-meta", opts.CompressMeta, "gzip the checksums and report")
+	flag.BoolVar(&opts.WriteReport, "report", opts.WriteReport, "write a "+ReportFile+" of the run")
+	flag.StringVar(&opts.MetaDir, "meta", opts.MetaDir, "directory for "+SumsFile+" and "+ReportFile+" if not the chunk directory (- for stdout)")
+	flag.BoolVar(&quiet, "quiet", quiet, "only log errors")
+	flag.BoolVar(&opts.Verbose, "verbose", opts.Verbose, "log each chunk as it is found")
+	flag.BoolVar(&merge, "merge", merge, "merge the chunks in chunk-dir back into dest-file")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "list the chunks that would be written, as tab separated index, offset, end, size and name, or with -merge those that would be merged")
+	flag.BoolVar(&verify, "verify", verify, "verify the chunks in chunk-dir against their checksums")
+	flag.StringVar(&extract, "extract", extract, "copy lines M,N of src-file to dest-file instead of chunking")
+	flag.StringVar(&extractBytes, "extract-bytes", extractBytes, "copy bytes OFF,END of src-file to dest-file instead of chunking")
+	flag.BoolVar(&snap, "snap", snap, "align -extract-bytes to whole lines")
 	flag.Parse()
 
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, split := range []string{"lines", "key-field", "parts"} {
+		for _, other := range []string{"size", "chunks", "lines", "key-field", "parts"} {
+			if split != other && set[split] && set[other] {
+				log.Fatalf("-%s can't be used with -%s", split, other)
+			}
+		}
+	}
+
+	if quiet {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	if hold {
+		opts.Incomplete = HoldIncomplete
+	}
+	if parts > 0 {
+		opts.MaxChunks, opts.Size = parts, math.MaxInt64
+	}
+	if keyField > 0 {
+		if len(keySep) != 1 {
+			log.Fatalf("-key-sep must be a single byte")
+		}
+		opts.Key = FieldKey(keySep[0], keyField-1)
+	}
+
 	args := flag.Args()
+	if merge {
+		if len(args) < 2 && !(dryRun && len(args) == 1) {
+			log.Fatalf("usage: %s -merge [-verify] [-dry-run] chunk-dir dest-file", os.Args[0])
+		}
+		mopts := MergeOptions{Prefix: opts.Prefix, Verify: verify, MetaDir: opts.MetaDir, ChecksumAlgo: opts.ChecksumAlgo}
+		if dryRun {
+			plan, err := PlanMerge(args[0], mopts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, name := range plan.Names {
+				fmt.Println(name)
+			}
+			fmt.Printf("%d chunks, %d bytes\n", len(plan.Names), plan.Size)
+			if len(plan.Missing) > 0 {
+				log.Fatalf("missing chunks: %s", plan.missing())
+			}
+			return
+		}
+		if err := MergeWith(args[0], args[1], mopts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if verify {
+		if len(args) < 1 {
+			log.Fatalf("usage: %s -verify chunk-dir", os.Args[0])
+		}
+		if err := VerifyAlgo(args[0], opts.MetaDir, opts.ChecksumAlgo); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if extract != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(extract, "%d,%d", &start, &end); err != nil || len(args) < 2 {
+			log.Fatalf("usage: %s -extract M,N src-file dest-file", os.Args[0])
+		}
+		if err := ExtractLines(args[0], args[1], start, end); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if extractBytes != "" {
+		var off, end int64
+		if _, err := fmt.Sscanf(extractBytes, "%d,%d", &off, &end); err != nil || len(args) < 2 {
+			log.Fatalf("usage: %s -extract-bytes OFF,END [-snap] src-file dest-file", os.Args[0])
+		}
+		if err := ExtractBytes(args[0], args[1], off, end, snap); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if files != "" || recursive {
+		var (
+			list []string
+			dest string
+			err  error
+		)
+		if recursive {
+			if len(args) < 2 {
+				log.Fatalf("usage: %s -recursive src-dir dest-dir", os.Args[0])
+			}
+			dest = args[1]
+			list, err = walkSources(args[0], dest)
+		} else {
+			if len(args) < 1 {
+				log.Fatalf("usage: %s -files list-file dest-dir", os.Args[0])
+			}
+			dest = args[0]
+			list, err = readFileList(files)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		var root string
+		if recursive {
+			root = args[0]
+		}
+		dirs, err := sourceDirs(dest, root, list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// one at a time, so the workers bound all of them
+		var failed int
+		for i, filename := range list {
+			if _, err := ChunkFileWith(filename, dirs[i], opts); err != nil {
+				log.Printf("%s: %v\n", filename, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d files failed", failed, len(list))
+		}
+		return
+	}
+	if countLines {
+		if len(args) < 1 {
+			log.Fatalf("usage: %s -count src-file", os.Args[0])
+		}
+		counts, err := NewChunker(opts).CountLines(context.Background(), args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var total int64
+		for _, c := range counts {
+			fmt.Printf("%d\t%d\t%d\n", c.Index, c.Size, c.Lines)
+			total += c.Lines
+		}
+		opts.Logger.Printf("%d chunks, %d lines\n", len(counts), total)
+		return
+	}
 	if len(args) < 2 {
-		log.Fatalf("usage: %s src-file dest-dir", os.Args[0])
+		log.Fatalf("usage: %s src-file dest-dir (- for framed chunks on stdout)", os.Args[0])
 	}
 	filename := args[0]
 	dir := args[1]
 	now := time.Now()
-	if err := ChunkFile(filename, dir, prefix, size, workers, skip); err != nil {
-		log.Fatal(err)
+	if dir == "-" {
+		if _, err := WriteFrames(filename, os.Stdout, opts); err != nil {
+			log.Fatal(err)
+		}
+	} else if dryRun {
+		chunks, err := NewChunker(opts).Plan(filename, dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, c := range chunks {
+			fmt.Printf("%d\t%d\t%d\t%d\t%s\n", c.Index, c.Section.off, c.Section.end, c.Size, c.Name)
+		}
+		opts.Logger.Printf("%d chunks\n", len(chunks))
+	} else if from >= 0 {
+		next, err := ChunkFileFrom(filename, dir, from, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(next)
+	} else if index {
+		if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+			log.Fatal(err)
+		}
+		ext := opts.Ext
+		if ext == "" {
+			ext = sourceExt(filename)
+		}
+		dest := path.Join(dir, opts.Prefix+ext)
+		if err := IndexFileWith(filename, dest, opts); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		var res Result
+		var err error
+		switch {
+		case filename == "-" && spool:
+			res, err = NewChunker(opts).ChunkSpooled(ctx, os.Stdin, dir)
+		case filename == "-":
+			res, err = NewChunker(opts).ChunkStreamed(ctx, os.Stdin, dir)
+		default:
+			res, err = ChunkFileContext(ctx, filename, dir, opts)
+		}
+		stop()
+		if errors.Is(err, context.Canceled) {
+			log.Fatalf("interrupted: %d chunks were completed, partial chunks were removed", len(res.Chunks))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n := len(res.Incomplete); n > 0 {
+			opts.Logger.Printf("held back an incomplete final line of %d bytes\n", n)
+		}
 	}
-	log.Println("elapsed time:", time.Since(now))
+	opts.debugf("elapsed time: %s\n", time.Since(now))
 
 }
 
+// ReaderAt is the random access source that chunks are cut from,
+// as satisfied by *mmap.ReaderAt
+type ReaderAt interface {
+	At(i int) byte
+	Close() error
+	Len() int
+	ReadAt(p []byte, off int64) (int, error)
+}
+
+// bytesReaderAt is a ReaderAt over an in-memory slice
+type bytesReaderAt struct {
+	b []byte
+}
+
+// NewBytesReaderAt returns a ReaderAt over b,
+// so that in-memory data can be chunked without mmap
+func NewBytesReaderAt(b []byte) ReaderAt {
+	return &bytesReaderAt{b}
+}
+
+func (r *bytesReaderAt) At(i int) byte { return r.b[i] }
+func (r *bytesReaderAt) Close() error  { return nil }
+func (r *bytesReaderAt) Len() int      { return len(r.b) }
+
+func (r *bytesReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(r.b)) {
+		return 0, fmt.Errorf("invalid ReadAt offset %d", off)
+	}
+	n := copy(p, r.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileReaderAt is a ReaderAt over a file of an fs.FS
+type fileReaderAt struct {
+	f    fs.File
+	ra   io.ReaderAt
+	size int64
+}
+
+// OpenFS opens name in fsys as a ReaderAt for Chunker.ChunkReader, so
+// that embedded or otherwise virtual files can be chunked. A file that
+// can't be read at an offset is read into memory instead.
+func OpenFS(fsys fs.FS, name string) (ReaderAt, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return &fileReaderAt{f, ra, fi.Size()}, nil
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return NewBytesReaderAt(b), nil
+}
+
+func (r *fileReaderAt) At(i int) byte {
+	var b [1]byte
+	r.ra.ReadAt(b[:], int64(i))
+	return b[0]
+}
+
+func (r *fileReaderAt) Close() error { return r.f.Close() }
+func (r *fileReaderAt) Len() int     { return int(r.size) }
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.ra.ReadAt(p, off)
+}
+
 // return a list of sections of ~ size
 // it will check at the size offset, then work back until
 // it finds a newline
-func chunkyBySize(mf *mmap.ReaderAt, size int64) ([]Section, error) {
+func chunkyBySize(mf ReaderAt, size int64) ([]Section, error) {
 	var sections []Section
-	fsize := int64(mf.Len())
-	if size > fsize {
-		sections = append(sections, Section{0, fsize})
-		return sections, nil
+	err := SectionsBySize(mf, size, func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	return sections, err
+}
+
+// SectionsBySize calls fn with each section of ~ size as it is found,
+// so that callers can process a huge file's sections without holding
+// them all in memory. Iteration stops at the first error from fn,
+// which is returned.
+func SectionsBySize(mf ReaderAt, size int64, fn func(Section) error) error {
+	opts := Options{Size: size}.withDefaults()
+	return sectionsBySize(mf, 0, int64(mf.Len()), opts, fn)
+}
+
+// sectionsBySize finds the sections of ~ opts.Size between off and end
+func sectionsBySize(mf ReaderAt, off, end int64, opts Options, fn func(Section) error) error {
+	size := opts.Size
+	if size > end-off {
+		return fn(Section{off, end})
+	}
+
+	buf := make([]byte, opts.SearchPage)
+	for idx := 0; off < end; idx++ {
+		next, err := sectionEnd(mf, off, end, size, buf, opts)
+		if err != nil {
+			return err
+		}
+		opts.debugf("chunk from %016d:%012d (%16d)\n", off, next, next-off)
+		if err := checkOversize(opts, idx, next-off, size); err != nil {
+			return err
+		}
+		if err := fn(Section{off, next}); err != nil {
+			return err
+		}
+		off = next
 	}
+	return nil
+}
 
-	var offset int64
-	page := int64(4096)
+// sectionEnd returns the end of the section of ~ size from off, just
+// past the last delim in its final page, read into buf, or if the page
+// has none the first delim after it, but no further than end
+func sectionEnd(mf ReaderAt, off, end, size int64, buf []byte, opts Options) (int64, error) {
+	// compared as a length, as a size of math.MaxInt64 would overflow
+	if size > end-off {
+		return end, nil
+	}
+	next := off + size
+	page := int64(len(buf))
 	if page > size {
 		page = size
 	}
-	buf := make([]byte, page)
-	for offset < fsize {
-		next := offset + size
-		if next > fsize {
-			next = fsize
-		} else {
-			// get the final page of this secton
-			n, err := mf.ReadAt(buf, next-page)
-			if err != nil {
-				return sections, err
+	// get the final page of this secton
+	n, err := mf.ReadAt(buf[:page], next-page)
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	if n < int(page) {
+		// not a full page so that's as close to the end as we get
+		last = int64(n) - 1
+	} else {
+		last = int64(bytes.LastIndexByte(buf[:page], opts.delim()))
+	}
+	if last < 0 {
+		// no newline to back up to, so the line is longer than
+		// the page and the section runs on to the end of it
+		return nextLineEnd(mf, next, end, opts.SearchPage, opts.delim())
+	}
+	// end just past the newline
+	return next - page + last + 1, nil
+}
+
+// checkOversize warns about section idx of n bytes if it is over
+// opts.OversizeFactor times size, or fails with opts.StrictSize
+func checkOversize(opts Options, idx int, n, size int64) error {
+	if float64(n) <= float64(size)*opts.OversizeFactor {
+		return nil
+	}
+	err := fmt.Errorf("section %d is %d bytes, over %gx the %d byte target", idx, n, opts.OversizeFactor, size)
+	if opts.StrictSize {
+		return err
+	}
+	opts.Logger.Printf("warning: %v\n", err)
+	return nil
+}
+
+// ChunksByCount returns a list of n sections of about the same size,
+// each ended on a newline. If there are fewer than n lines there are
+// fewer sections, as none is ever empty.
+func ChunksByCount(filename string, n int) ([]Section, error) {
+	mf, err := openSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+
+	var sections []Section
+	opts := Options{MaxChunks: n, Size: math.MaxInt64}.withDefaults()
+	err = sectionsByCount(mf, 0, int64(mf.Len()), opts, func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	return sections, err
+}
+
+// sectionsByCount splits the bytes between off and end into at most
+// opts.MaxChunks sections of about the same size, unless that would make
+// them bigger than opts.Size, in which case the size wins and there are
+// more. Each section's target is what's left shared among the sections
+// left, so those cut short by ending on a newline are made up for later.
+// Only opts.Size, not a section's share, makes a section oversize.
+func sectionsByCount(mf ReaderAt, off, end int64, opts Options, fn func(Section) error) error {
+	if off == end {
+		return fn(Section{off, end})
+	}
+	buf := make([]byte, opts.SearchPage)
+	for count := 0; off < end; count++ {
+		size := opts.Size
+		left := int64(opts.MaxChunks - count)
+		if left > 0 {
+			if share := (end - off + left - 1) / left; share < size {
+				size = share
 			}
-			var last int64
-			if n < int(page) {
-				// not a full page so that's as close to the end as we get
-				last = int64(n)
-			} else {
-				last = int64(bytes.LastIndexByte(buf, byte('\n')))
+		}
+		next := end
+		// the last section takes the rest, even without a newline to end on
+		if left != 1 || end-off > opts.Size {
+			var err error
+			if next, err = sectionEnd(mf, off, end, size, buf, opts); err != nil {
+				return err
 			}
-			next = offset + size - page + last
 		}
-		sections = append(sections, Section{offset, next})
-		log.Printf("chunk from %016d:%012d (%16d)\n", offset, next, next-offset)
-		offset = next + 1
+		opts.debugf("chunk from %016d:%012d (%16d)\n", off, next, next-off)
+		if err := checkOversize(opts, count, next-off, opts.Size); err != nil {
+			return err
+		}
+		if err := fn(Section{off, next}); err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// nextLineEnd returns the offset just past the first delim at or after
+// start, or end if there is none before it, searching a page at a time
+func nextLineEnd(mf ReaderAt, start, end, page int64, delim byte) (int64, error) {
+	buf := make([]byte, page)
+	for off := start; off < end; off += int64(len(buf)) {
+		if int64(len(buf)) > end-off {
+			buf = buf[:end-off]
+		}
+		n, err := mf.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.IndexByte(buf[:n], delim); i >= 0 {
+			return off + int64(i) + 1, nil
+		}
+	}
+	return end, nil
+}
+
+// lastLineEnd returns the offset just past the last delim at or after
+// start, or start if there is none, searching a page at a time
+func lastLineEnd(mf ReaderAt, start, page int64, delim byte) (int64, error) {
+	buf := make([]byte, page)
+	end := int64(mf.Len())
+	for end > start {
+		off := end - int64(len(buf))
+		if off < start {
+			off = start
+		}
+		n, err := mf.ReadAt(buf[:end-off], off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], delim); i >= 0 {
+			return off + int64(i) + 1, nil
+		}
+		end = off
 	}
-	return sections, nil
+	return start, nil
 }
 
 // ChunksBySize returns a list of offsets of text sized to be at or under
 // the given size. It will be adjusted to split on a newline.
 func ChunksBySize(filename string, size int64) ([]Section, error) {
 	var sections []Section
-	mf, err := mmap.Open(filename)
+	mf, err := openSource(filename)
 	if err != nil {
 		return sections, err
 	}
@@ -107,106 +614,736 @@ func ChunksBySize(filename string, size int64) ([]Section, error) {
 	return chunkyBySize(mf, size)
 }
 
-// Section is a tuple of memory offset and size
+// EstimateChunks is roughly how many chunks of size a file of fileSize
+// will be split into, without reading it, e.g. to size a progress bar.
+// Sections end on newlines, so the actual count can differ slightly.
+func EstimateChunks(fileSize, size int64) int {
+	size = Options{Size: size}.withDefaults().Size
+	return int((fileSize + size - 1) / size)
+}
+
+// CountChunks is the exact number of chunks of size filename will be
+// split into, found by scanning it for the section boundaries
+func CountChunks(filename string, size int64) (int, error) {
+	mf, err := openSource(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer mf.Close()
+
+	var count int
+	err = SectionsBySize(mf, size, func(Section) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Section is a tuple of memory offset and end,
+// covering the bytes from off up to but not including end
 type Section struct {
 	off int64
 	end int64
 }
 
-// Carve is a filewriter helper
-func Carve(r io.Reader, filename string) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
+// Reader returns a reader over the section's bytes of r
+func (s Section) Reader(r ReaderAt) io.Reader {
+	return &mreader{r, s.off, s.end - s.off}
+}
+
+// check that the section lies within a source of size bytes
+func (s Section) check(size int64) error {
+	switch {
+	case s.off < 0:
+		return fmt.Errorf("offset %d is negative", s.off)
+	case s.off > s.end:
+		return fmt.Errorf("offset %d is past end %d", s.off, s.end)
+	case s.end > size:
+		return fmt.Errorf("end %d is past the end of the source (%d bytes)", s.end, size)
 	}
-	const WriteBufferSize = 16777216 // 32768 // 65536
-	w := bufio.NewWriterSize(f, WriteBufferSize)
-	if _, err := io.Copy(w, r); err != nil {
-		return err
+	return nil
+}
+
+// skipTo returns the offset of the first line to chunk, past the first
+// opts.Skip lines of mf and then any lines before one matching opts.SkipUntil
+func skipTo(mf ReaderAt, opts Options) (int64, error) {
+	var off int64
+	if opts.Skip > 0 {
+		var err error
+		if off, err = skipLines(mf, opts.Skip, opts.delim()); err != nil {
+			return 0, fmt.Errorf("failed to skip lines: %w", err)
+		}
 	}
-	if err = w.Flush(); err != nil {
-		return err
+	if opts.SkipUntil != nil {
+		return skipUntil(mf, off, opts.SkipUntil, opts.delim())
 	}
-	return f.Close()
+	return off, nil
 }
 
-func skipLines(mf *mmap.ReaderAt, lines int) (int64, error) {
-	buf := make([]byte, 1<<16) // 1 megabyte should be enough :-)
-	n, err := mf.ReadAt(buf, 0)
-	if err != nil {
+// skipUntil returns the offset of the first line, ended by delim, at or
+// after off matching re, reading a line at a time
+func skipUntil(mf ReaderAt, off int64, re *regexp.Regexp, delim byte) (int64, error) {
+	var line []byte
+	it := lineIter(mf, off, delim)
+	for it.Next() {
+		start, end := it.Line()
+		if n := int(end - start); cap(line) < n {
+			line = make([]byte, n)
+		} else {
+			line = line[:n]
+		}
+		if _, err := mf.ReadAt(line, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if re.Match(trimDelim(line, delim)) {
+			return start, nil
+		}
+	}
+	if err := it.Err(); err != nil {
 		return 0, err
 	}
-	buf = buf[:n]
-	var offset int64
-	for lines > 0 {
-		lines--
-		idx := bytes.Index(buf, []byte("\n"))
-		if idx < 0 {
-			return 0, fmt.Errorf("newline not found")
-		}
-		idx++
-		offset += int64(idx)
-		buf = buf[idx:]
+	return 0, fmt.Errorf("no line matches %q", re)
+}
+
+// skipLines returns the offset of the first line after the first lines
+// lines ended by delim, failing if there are fewer
+func skipLines(mf ReaderAt, lines int, delim byte) (int64, error) {
+	off, found, err := lineOffset(mf, 0, int64(mf.Len()), lines, delim)
+	if err == nil && found < lines {
+		err = fmt.Errorf("only %d of %d lines found", found, lines)
 	}
-	return offset, nil
+	return off, err
 }
 
 // FileChunks splits the given files into smaller chunks,
-// as specified by each section offset and endpoint
-func FileChunks(source, dir, prefix string, workers, skip int, sections []Section) error {
-	mf, err := mmap.Open(source)
+// as specified by each section offset and endpoint.
+// The first carve error cancels the remaining sections and is returned.
+//
+// Chunks are carved concurrently, but the output is deterministic:
+// each file's name is derived from its section index and offsets and
+// its content from that byte range alone, so the same source and options
+// always produce byte-identical files with identical names.
+//
+// The absolute paths of the chunks written are returned in section order,
+// so they can be handed on without globbing dir.
+func FileChunks(source, dir, prefix string, workers, skip int, sections []Section) ([]string, error) {
+	opts := Options{Prefix: prefix, Workers: workers, Skip: skip}
+	res, err := FileChunksWith(source, dir, sections, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return res.Paths()
+}
 
-	defer mf.Close()
-	ctx := context.TODO()
-	sem := semaphore.NewWeighted(int64(workers))
-	log.Printf("chunkng with %d threads for %d sections\n", workers, len(sections))
+// FileChunksWith is FileChunks configured by opts
+func FileChunksWith(source, dir string, sections []Section, opts Options) (Result, error) {
+	return FileChunksContext(context.Background(), source, dir, sections, opts)
+}
+
+// FileChunksContext is FileChunksWith, stopping early if ctx is cancelled
+// as ChunkFileContext does
+func FileChunksContext(ctx context.Context, source, dir string, sections []Section, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+	mf, err := openSource(source)
+	if err != nil {
+		return Result{}, err
+	}
 
-	ext := path.Ext(source)
-	var wg sync.WaitGroup
-	wg.Add(len(sections))
+	defer mf.Close()
+	before, err := os.Stat(source)
+	if err != nil {
+		return Result{}, err
+	}
+	fsize := int64(mf.Len())
 	for i, s := range sections {
-		filename := fmt.Sprintf(fileTemplate, dir, prefix, i, s.off, s.end, ext)
-		if err := sem.Acquire(ctx, 1); err != nil {
-			log.Printf("Failed to acquire semaphore: %v", err)
+		if err := s.check(fsize); err != nil {
+			return Result{}, fmt.Errorf("invalid section %d: %w", i, err)
+		}
+	}
+
+	start, err := skipTo(mf, opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	opts.debugf("chunkng with %d threads for %d sections\n", opts.Workers, len(sections))
+	c, err := newCarver(ctx, mf, source, dir, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	c.skipped = start
+	c.found = len(sections)
+	// the first may start past the skipped lines, so leave the caller's be
+	sections = append([]Section(nil), sections...)
+	for i := range sections {
+		if i == 0 && start > sections[i].off && start <= sections[i].end {
+			sections[i].off = start
+		}
+		c.total += sections[i].end - sections[i].off
+	}
+	add := dropEmpty(opts, c.add)
+	for _, s := range sections {
+		if err = add(s); err != nil {
 			break
 		}
-		if i == 0 && skip > 0 {
-			idx, err := skipLines(mf, skip)
+	}
+	err = c.wait(err)
+	if err == nil {
+		err = checkUnchanged(source, before)
+	}
+	res := c.result()
+	res.summary(opts.Logger)
+	return res, reportRun(dir, source, before, opts, res, err)
+}
+
+// ChunkFile splits filename into size chunks into dir, returning
+// the absolute paths of the chunks in order
+func ChunkFile(filename, dir, prefix string, size int64, workers, skip int) ([]string, error) {
+	opts := Options{Prefix: prefix, Size: size, Workers: workers, Skip: skip}
+	res, err := ChunkFileWith(filename, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Paths()
+}
+
+// ChunkFileWith is ChunkFile configured by opts, returning what was written.
+// Sections are carved as they are found rather than collected first.
+func ChunkFileWith(filename, dir string, opts Options) (Result, error) {
+	return ChunkFileContext(context.Background(), filename, dir, opts)
+}
+
+// ChunkFileContext is ChunkFileWith, stopping early if ctx is cancelled.
+// Carves in progress are then abandoned and their partial files removed,
+// so the Result lists only complete chunks, and ctx.Err() is returned.
+func ChunkFileContext(ctx context.Context, filename, dir string, opts Options) (Result, error) {
+	return NewChunker(opts).ChunkContext(ctx, filename, dir)
+}
+
+// ChunkFileFrom chunks only the part of a growing file appended since
+// offset, e.g. the offset returned by a previous run. Chunks stop at the
+// last complete line so a line being written is never split, and the
+// offset to resume from next time is returned. Skip only applies when
+// starting from the beginning of the file. Chunks can't be padded, as
+// each run's report would replace the real sizes recorded by the last,
+// and the offsets are of the file as it is, so it can't be gzipped.
+//
+// Unless StartIndex is set, a run from past the beginning numbers its
+// chunks on from the highest index of those already in dir, and with
+// Checksums adds theirs to the checksum file already there, so that
+// the chunks of every run merge back as one.
+func ChunkFileFrom(filename, dir string, offset int64, opts Options) (int64, error) {
+	opts = opts.withDefaults()
+	if opts.PadTo > 0 {
+		return offset, fmt.Errorf("chunks appended to can't be padded")
+	}
+	if opts.gzipped(filename) {
+		return offset, fmt.Errorf("can't append the chunks of gzipped %q", filename)
+	}
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return offset, err
+	}
+	if err := checkWritable(dir); err != nil {
+		return offset, err
+	}
+	if offset > 0 && opts.StartIndex == 0 {
+		next, err := nextIndex(dir, opts.Prefix)
+		if err != nil {
+			return offset, err
+		}
+		opts.StartIndex = next
+	}
+	mf, err := openSource(filename)
+	if err != nil {
+		return offset, err
+	}
+	defer mf.Close()
+
+	if offset > int64(mf.Len()) {
+		return offset, fmt.Errorf("offset %d is past the end of %q (%d bytes), was it truncated?", offset, filename, mf.Len())
+	}
+	start := offset
+	if offset == 0 {
+		if start, err = skipTo(mf, opts); err != nil {
+			return offset, err
+		}
+	}
+	end, err := lastLineEnd(mf, start, opts.SearchPage, opts.delim())
+	if err != nil || end == start {
+		return offset, err
+	}
+
+	opts.debugf("chunkng with %d threads from offset %d\n", opts.Workers, offset)
+	c, err := newCarver(context.Background(), mf, filename, dir, opts)
+	if err != nil {
+		return offset, err
+	}
+	c.skipped = start - offset
+	c.total = end - start
+	if offset > 0 && opts.Checksums && opts.MetaDir != "-" {
+		// the checksum file is rewritten, so keep the earlier chunks in it
+		c.prior, err = readSums(dir, opts.MetaDir, c.algo.file)
+		if err != nil && !os.IsNotExist(err) {
+			return offset, err
+		}
+	}
+	err = c.wait(findSections(mf, start, end, c.opts, c.add))
+	c.result().summary(opts.Logger)
+	if err != nil {
+		return offset, err
+	}
+	return end, nil
+}
+
+// nextIndex returns the index after the highest of the chunks of prefix
+// in dir, or 0 if there are none
+func nextIndex(dir, prefix string) (int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, prefix+"-*"))
+	if err != nil {
+		return 0, err
+	}
+	var next int
+	for _, name := range names {
+		if i, ok := chunkIndex(name, prefix); ok && i >= next {
+			next = i + 1
+		}
+	}
+	return next, nil
+}
+
+// carver carves sections of a source into files on a bounded
+// number of goroutines
+type carver struct {
+	parent context.Context
+	mf     ReaderAt
+	name   namer
+	dir    string
+	opts   Options
+	algo   checksumAlgo
+	g      *errgroup.Group
+	ctx    context.Context
+	sem    *semaphore.Weighted
+	count  int
+	header []byte     // prepended to chunks not at the start of the source
+	prior  []sumEntry // checksums of earlier runs' chunks to keep
+
+	start   time.Time
+	elapsed time.Duration
+
+	mu      sync.Mutex
+	chunks  []Chunk
+	skipped int64
+	failed  []failure
+	found   int   // sections found
+	done    int64 // bytes of the source carved
+	total   int64 // bytes to carve
+}
+
+// failure is a chunk that failed to carve
+type failure struct {
+	index int
+	err   error
+}
+
+// Result describes the outcome of chunking a file
+type Result struct {
+	// Chunks written, in index order
+	Chunks []Chunk
+
+	// Skipped is the number of bytes skipped at the start of the source
+	// by Options.Skip, i.e. the offset the first chunk starts from
+	Skipped int64
+
+	// Bytes is the total of the source carved into the chunks,
+	// not counting the header repeated in each
+	Bytes int64
+
+	// Duration is the wall time taken
+	Duration time.Duration
+
+	// Incomplete is the final record of a streamed source left out of
+	// the chunks for want of a delimiter, under HoldIncomplete
+	Incomplete []byte
+}
+
+// MBPerSec is the throughput of the run in megabytes per second
+func (r Result) MBPerSec() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / (1 << 20) / r.Duration.Seconds()
+}
+
+// Paths returns the absolute paths of the chunks, in index order
+func (r Result) Paths() ([]string, error) {
+	paths := make([]string, len(r.Chunks))
+	for i, c := range r.Chunks {
+		p, err := filepath.Abs(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = p
+	}
+	return paths, nil
+}
+
+// summary logs the result as a single line of key=value pairs,
+// so it can be parsed by monitoring systems
+func (r Result) summary(logger *log.Logger) {
+	logger.Printf("summary chunks=%d bytes=%d skipped=%d duration=%s mb_per_sec=%.2f\n",
+		len(r.Chunks), r.Bytes, r.Skipped, r.Duration, r.MBPerSec())
+}
+
+// Chunk describes a carved chunk file
+type Chunk struct {
+	Index   int     // counting from Options.StartIndex
+	Name    string  // path of the chunk file
+	Section Section // range of the source it holds
+	Size    int64   // bytes carved from the source, and any header
+	Sum     []byte  // checksum of the file, if checksums are enabled
+}
+
+func newCarver(parent context.Context, mf ReaderAt, source, dir string, opts Options) (*carver, error) {
+	if len(opts.Delimiter) > 1 {
+		return nil, fmt.Errorf("delimiter %q is not a single byte", opts.Delimiter)
+	}
+	if opts.Compress && opts.PadTo > 0 {
+		return nil, fmt.Errorf("compressed chunks can't be padded")
+	}
+	if opts.Overlap > 0 && opts.Overlap >= opts.Size {
+		return nil, fmt.Errorf("overlap of %d bytes must be less than the %d byte chunk size", opts.Overlap, opts.Size)
+	}
+	name, err := newNamer(source, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	var algo checksumAlgo
+	if opts.Checksums {
+		if algo, err = lookupAlgo(opts.ChecksumAlgo); err != nil {
+			return nil, err
+		}
+	}
+	g, ctx := errgroup.WithContext(parent)
+	c := &carver{
+		parent: parent,
+		mf:     mf,
+		name:   name,
+		dir:    dir,
+		opts:   opts,
+		algo:   algo,
+		g:      g,
+		ctx:    ctx,
+		sem:    semaphore.NewWeighted(int64(opts.Workers)),
+		count:  opts.StartIndex,
+		start:  time.Now(),
+	}
+	if opts.Header && mf != nil {
+		header, err := firstLine(mf, opts.delim())
+		if err != nil {
+			return nil, fmt.Errorf("reading the header: %w", err)
+		}
+		c.setHeader(header)
+	}
+	return c, nil
+}
+
+// setHeader sets the header to prepend to the chunks, leaving room
+// for it in chunks by size
+func (c *carver) setHeader(header []byte) {
+	c.header = header
+	if n := int64(len(header)); n < c.opts.Size {
+		c.opts.Size -= n
+	}
+}
+
+// add starts carving the next section, waiting for a free worker
+func (c *carver) add(s Section) error {
+	i := c.next()
+	filename, err := c.name(i, s)
+	if err != nil {
+		return fmt.Errorf("naming section %d: %w", i, err)
+	}
+	if err := c.sem.Acquire(c.ctx, 1); err != nil {
+		// a carve has failed and cancelled the group
+		return err
+	}
+	seg := c.withHeader(s.off, Segment(c.mf, s.off, s.end))
+	c.g.Go(func() error {
+		defer c.sem.Release(1)
+		ctx := c.ctx
+		if c.opts.PerChunkTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.opts.PerChunkTimeout)
+			defer cancel()
+		}
+		if c.opts.Resume && c.opts.Sink == nil {
+			chunk, ok, err := c.existing(i, filename, s)
 			if err != nil {
-				return fmt.Errorf("failed to skip lines: %w", err)
+				return err
+			}
+			if ok {
+				c.record(chunk, nil)
+				return nil
 			}
-			s.off = idx
 		}
-		r := Segment(mf, s.off, s.end)
-		go func(r io.Reader, idx int, f string) {
-			if err := Carve(r, f); err != nil {
-				log.Printf("error carving to file %q: %v", f, err)
+		r := &contextReader{ctx, seg}
+		copts, h := c.carveOptions(s.end - s.off)
+		var n int64
+		var err error
+		if c.opts.Sink != nil {
+			n, err = CarveToSink(r, filename, c.opts.Sink, copts)
+		} else {
+			n, err = CarveWith(r, filename, copts)
+		}
+		if err == nil && c.opts.PerChunkTimeout > 0 && ctx.Err() != nil {
+			// the reads beat the timeout, but not the writes after them
+			if c.opts.Sink == nil {
+				os.Remove(filename)
+			}
+			err = ctx.Err()
+		}
+		if err != nil {
+			err = fmt.Errorf("carving section %d to %q: %w", i, filename, err)
+			// a chunk timing out is just another failure,
+			// only cancelling the whole job stops the rest
+			if c.opts.KeepGoing && c.ctx.Err() == nil {
+				c.mu.Lock()
+				c.failed = append(c.failed, failure{i, err})
+				c.mu.Unlock()
+				return nil
 			}
-			sem.Release(1)
-			wg.Done()
-		}(r, i, filename)
+			return err
+		}
+		c.record(Chunk{Index: i, Name: filename, Section: s, Size: n}, h)
+		return nil
+	})
+	return nil
+}
+
+// withHeader prepends the header to r, the section at off,
+// unless it starts the source and so has it already
+func (c *carver) withHeader(off int64, r io.Reader) io.Reader {
+	if len(c.header) == 0 || off == 0 {
+		return r
+	}
+	return io.MultiReader(bytes.NewReader(c.header), r)
+}
+
+// existing returns the chunk for section i if filename is already there
+// and the size it would be carved to, checksumming it if need be
+func (c *carver) existing(i int, filename string, s Section) (Chunk, bool, error) {
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return Chunk{}, false, nil
+	}
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	size := s.end - s.off
+	if s.off > 0 {
+		size += int64(len(c.header))
+	}
+	switch {
+	case c.opts.PadTo > 0:
+		if fi.Size() != c.opts.PadTo {
+			return Chunk{}, false, nil
+		}
+	case !c.opts.Compress:
+		if fi.Size() != size {
+			return Chunk{}, false, nil
+		}
+	}
+	chunk := Chunk{Index: i, Name: filename, Section: s, Size: size}
+	if c.opts.Checksums {
+		f, err := os.Open(filename)
+		if err != nil {
+			return Chunk{}, false, err
+		}
+		defer f.Close()
+		h := c.algo.new()
+		if _, err := io.Copy(h, f); err != nil {
+			return Chunk{}, false, err
+		}
+		chunk.Sum = h.Sum(nil)
+	}
+	c.opts.debugf("keeping %s\n", filename)
+	return chunk, true, nil
+}
+
+// next returns the index of the next section, counting it as found
+func (c *carver) next() int {
+	i := c.count
+	c.count++
+	c.mu.Lock()
+	if n := c.count - c.opts.StartIndex; n > c.found {
+		c.found = n
+	}
+	c.mu.Unlock()
+	return i
+}
+
+// carveOptions returns how to carve a section of size bytes,
+// with the hash to checksum it by if checksums are enabled
+func (c *carver) carveOptions(size int64) (CarveOptions, hash.Hash) {
+	copts := CarveOptions{Atomic: true, Compress: c.opts.Compress, BufferSize: c.opts.BufferSize}
+	copts.PadTo, copts.PadByte = c.opts.PadTo, c.opts.PadByte
+	if c.opts.Preallocate {
+		copts.Preallocate = size
+		if c.opts.PadTo > 0 {
+			copts.Preallocate = c.opts.PadTo
+		}
+	}
+	var h hash.Hash
+	if c.opts.Checksums {
+		h = c.algo.new()
+		copts.Checksum = h
+	}
+	return copts, h
+}
+
+// record a carved chunk, summed by h if set, and report progress
+func (c *carver) record(chunk Chunk, h hash.Hash) {
+	if h != nil {
+		chunk.Sum = h.Sum(nil)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chunks = append(c.chunks, chunk)
+	c.done += c.carved(chunk)
+	if c.opts.Progress != nil {
+		c.opts.Progress(Progress{
+			Last:     chunk,
+			Chunks:   len(c.chunks),
+			Sections: c.found,
+			Bytes:    c.done,
+			Total:    c.total,
+		})
+	}
+}
+
+// wait for the carves in flight, returning the first carve error,
+// or else err from the producer of sections, unless the job as a whole
+// was cancelled. Once all is well the checksums are written, in index order.
+func (c *carver) wait(err error) error {
+	gerr := c.g.Wait()
+	c.elapsed = time.Since(c.start)
+	sort.Slice(c.chunks, func(i, j int) bool {
+		return c.chunks[i].Index < c.chunks[j].Index
+	})
+	if cerr := c.parent.Err(); cerr != nil {
+		return cerr
+	}
+	if gerr != nil {
+		return gerr
+	}
+	if err != nil {
+		return err
+	}
+	if len(c.failed) > 0 {
+		sort.Slice(c.failed, func(i, j int) bool {
+			return c.failed[i].index < c.failed[j].index
+		})
+		msgs := make([]string, len(c.failed))
+		for i, f := range c.failed {
+			msgs[i] = f.err.Error()
+		}
+		return fmt.Errorf("%d of %d chunks failed:\n%s", len(c.failed), c.count-c.opts.StartIndex, strings.Join(msgs, "\n"))
+	}
+	// a streamed source can't be read back, but its chunks
+	// end on a newline by construction
+	if c.opts.Validate && c.mf != nil {
+		if err := validateChunks(c.mf, c.chunks, c.opts.delim(), c.opts.Logger); err != nil {
+			return err
+		}
+	}
+	if c.opts.Checksums {
+		return writeSums(c.dir, c.opts.MetaDir, c.opts.CompressMeta, c.algo, c.prior, c.chunks)
 	}
-	wg.Wait()
 	return nil
 }
 
-// ChunkFile splits filename into size chunks into dir
-func ChunkFile(filename, dir, prefix string, size int64, workers, skip int) error {
-	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+// carved is how many bytes of the source were copied into chunk,
+// leaving out the header that chunks past the start are given
+func (c *carver) carved(chunk Chunk) int64 {
+	if chunk.Section.off > 0 {
+		return chunk.Size - int64(len(c.header))
+	}
+	return chunk.Size
+}
+
+// result of the carves, only valid after wait
+func (c *carver) result() Result {
+	r := Result{Chunks: c.chunks, Skipped: c.skipped, Duration: c.elapsed}
+	for _, chunk := range c.chunks {
+		r.Bytes += c.carved(chunk)
+	}
+	return r
+}
+
+// openSource maps filename, using its stat size as the source of truth.
+// On 32-bit platforms mmap lengths are an int, so a file over 2GB can't
+// be mapped and would otherwise corrupt the chunk math.
+func openSource(filename string) (*mmap.ReaderAt, error) {
+	fi, err := statSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	if size := fi.Size(); size != int64(int(size)) {
+		return nil, fmt.Errorf("source %q is %d bytes, too large to map on a %d-bit platform", filename, size, strconv.IntSize)
+	}
+	mf, err := mmap.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if int64(mf.Len()) != fi.Size() {
+		mf.Close()
+		return nil, fmt.Errorf("source %q mapped %d of %d bytes", filename, mf.Len(), fi.Size())
+	}
+	return mf, nil
+}
+
+// statSource stats filename, which must not be a directory
+func statSource(filename string) (fs.FileInfo, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("source %q is a directory; did you mean -recursive?", filename)
+	}
+	return fi, nil
+}
+
+// checkUnchanged fails if filename no longer has the size and
+// modification time it had before, i.e. it changed while being read
+func checkUnchanged(filename string, before fs.FileInfo) error {
+	after, err := os.Stat(filename)
+	if err != nil {
 		return err
 	}
-	list, err := ChunksBySize(filename, size)
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return fmt.Errorf("source %q changed while being chunked (%d bytes modified %s, now %d bytes modified %s)",
+			filename, before.Size(), before.ModTime().Format(time.RFC3339Nano), after.Size(), after.ModTime().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// checkWritable fails fast if files can't be created in dir,
+// rather than after a long split is underway
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".shred-probe-*")
 	if err != nil {
-		fmt.Println("chunk funk:", err)
+		return fmt.Errorf("destination %q is not writable: %w", dir, err)
 	}
-	return FileChunks(filename, dir, prefix, workers, skip, list)
+	f.Close()
+	return os.Remove(f.Name())
 }
 
+// mreader reads a segment of a ReaderAt. It has no WriteTo: reading
+// straight into the destination's writes benchmarked no faster than
+// io.Copy, as ReadAt copies out of the mapping either way.
 type mreader struct {
-	mm     *mmap.ReaderAt
+	mm     io.ReaderAt
 	offset int64
 	size   int64
 }
@@ -225,7 +1362,40 @@ func (m *mreader) Read(b []byte) (int, error) {
 }
 
 // Segment take a chunk of a memory mapped file and returns an io.Reader
-func Segment(mm *mmap.ReaderAt, offset, end int64) io.Reader {
-	size := end - offset + 1
-	return &mreader{mm, offset, size}
+func Segment(mm ReaderAt, offset, end int64) io.Reader {
+	return Section{offset, end}.Reader(mm)
+}
+
+// ExtractBytes copies the bytes from off up to end of filename to dest.
+// With snap the range is aligned to whole lines: off moves forward to the
+// start of a line and end to the end of one, just as chunks are split,
+// so ranges that tile a file extract lines that tile it too.
+func ExtractBytes(filename, dest string, off, end int64, snap bool) error {
+	mf, err := openSource(filename)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+
+	size := int64(mf.Len())
+	if off < 0 || end < off || end > size {
+		return fmt.Errorf("invalid byte range %d-%d of %q (%d bytes)", off, end, filename, size)
+	}
+	if snap {
+		if off > 0 {
+			if off, err = nextLineEnd(mf, off-1, size, DefaultSearchPage, '\n'); err != nil {
+				return err
+			}
+		}
+		if end > 0 {
+			if end, err = nextLineEnd(mf, end-1, size, DefaultSearchPage, '\n'); err != nil {
+				return err
+			}
+		}
+		if end < off {
+			end = off
+		}
+	}
+	_, err = CarveWith(Segment(mf, off, end), dest, CarveOptions{Atomic: true})
+	return err
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSource writes data to a file in a temporary directory
+func writeSource(t *testing.T, data string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "src.txt")
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// quiet are opts logging nothing, with small write buffers so that
+// the many tiny chunks of the tests are quick to carve
+func quiet(opts Options) Options {
+	opts.Logger = log.New(io.Discard, "", 0)
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 4096
+	}
+	return opts
+}
+
+// lines returns lines numbered from first through last
+func lines(first, last int) string {
+	var b bytes.Buffer
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	return b.String()
+}
+
+// checkCover fails unless sections are non-empty and tile size bytes
+func checkCover(t *testing.T, sections []Section, size int64) {
+	t.Helper()
+	var off int64
+	for i, s := range sections {
+		if s.off != off {
+			t.Fatalf("section %d starts at %d, want %d", i, s.off, off)
+		}
+		if s.end <= s.off {
+			t.Fatalf("section %d is empty: %v", i, s)
+		}
+		off = s.end
+	}
+	if off != size {
+		t.Fatalf("sections end at %d, want %d", off, size)
+	}
+}
+
+func TestChunksByCount(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		n    int
+		want int
+	}{
+		{"even", "a\nb\nc\nd\n", 2, 2},
+		{"no trailing newline", "a\nb\nc\nd\ne", 2, 2},
+		{"one line", "abcdef", 3, 1},
+		{"more parts than lines", "a\nb\nc\n", 10, 3},
+		{"long lines", "aaaaaaaaaa\nb\nc\nd\ne\nf\n", 4, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sections, err := ChunksByCount(writeSource(t, tc.data), tc.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCover(t, sections, int64(len(tc.data)))
+			if len(sections) > tc.want {
+				t.Errorf("got %d sections, want at most %d", len(sections), tc.want)
+			}
+		})
+	}
+}
+
+func TestHeaderProgress(t *testing.T) {
+	data := "id,name\n" + lines(1, 200)
+	src := writeSource(t, data)
+	var last Progress
+	opts := quiet(Options{Size: 300, Header: true, Progress: func(p Progress) { last = p }})
+	res, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "chunks"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Chunks) < 2 {
+		t.Fatalf("got %d chunks, want several", len(res.Chunks))
+	}
+	if f := last.ByteFraction(); f != 1 {
+		t.Errorf("progress ends at %g, want 1", f)
+	}
+	if res.Bytes != int64(len(data)) {
+		t.Errorf("carved %d bytes, want %d", res.Bytes, len(data))
+	}
+	var written int64
+	for _, c := range res.Chunks {
+		written += c.Size
+	}
+	if want := res.Bytes + int64(len(res.Chunks)-1)*8; written != want {
+		t.Errorf("chunks hold %d bytes, want %d with the headers", written, want)
+	}
+}
+
+// sectionsOf returns the sections findSections finds in data
+func sectionsOf(t *testing.T, data string, opts Options) []Section {
+	t.Helper()
+	opts = quiet(opts).withDefaults()
+	var sections []Section
+	err := findSections(NewBytesReaderAt([]byte(data)), 0, int64(len(data)), opts, func(s Section) error {
+		sections = append(sections, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sections
+}
+
+// checkLineEnds fails unless every section but the last ends with delim
+func checkLineEnds(t *testing.T, data string, sections []Section, delim byte) {
+	t.Helper()
+	for i, s := range sections[:len(sections)-1] {
+		if data[s.end-1] != delim {
+			t.Fatalf("section %d %v doesn't end on a line", i, s)
+		}
+	}
+}
+
+// readChunks concatenates the files named
+func readChunks(t *testing.T, names []string) string {
+	t.Helper()
+	var b bytes.Buffer
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(data)
+	}
+	return b.String()
+}
+
+func TestSectionsBySize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		size int64
+		page int64
+	}{
+		{"even", lines(1, 100), 100, 0},
+		{"no trailing newline", lines(1, 100) + "tail", 100, 0},
+		{"size of the source", lines(1, 10), int64(len(lines(1, 10))), 0},
+		{"bigger than the source", lines(1, 10), 1 << 20, 0},
+		{"one byte", lines(1, 10), 1, 0},
+		{"long line", strings.Repeat("x", 1000) + "\n" + lines(1, 50), 100, 0},
+		{"line longer than the page", lines(1, 20) + strings.Repeat("x", 300) + "\n" + lines(1, 20), 200, 16},
+		{"no newline at all", strings.Repeat("x", 500), 100, 0},
+		{"crlf", strings.Repeat("a line\r\n", 100), 37, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sections := sectionsOf(t, tc.data, Options{Size: tc.size, SearchPage: tc.page})
+			checkCover(t, sections, int64(len(tc.data)))
+			checkLineEnds(t, tc.data, sections, '\n')
+			for i, s := range sections {
+				// never between a \r and its \n
+				if s.off > 0 && tc.data[s.off] == '\n' {
+					t.Fatalf("section %d starts part way through a line ending", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSectionsByCount(t *testing.T) {
+	data := lines(1, 1000)
+	for _, tc := range []struct {
+		name  string
+		opts  Options
+		count int
+	}{
+		{"parts", Options{MaxChunks: 7, Size: math.MaxInt64}, 7},
+		{"size wins", Options{MaxChunks: 2, Size: 1000}, len(data)/1000 + 1},
+		{"more parts than lines", Options{MaxChunks: 5000, Size: math.MaxInt64}, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sections := sectionsOf(t, data, tc.opts)
+			checkCover(t, sections, int64(len(data)))
+			checkLineEnds(t, data, sections, '\n')
+			if len(sections) != tc.count {
+				t.Errorf("got %d sections, want %d", len(sections), tc.count)
+			}
+		})
+	}
+}
+
+func TestFileChunksRoundTrip(t *testing.T) {
+	data := lines(1, 500) + "no newline"
+	src := writeSource(t, data)
+	for _, size := range []int64{1, 7, 64, 1000, 1 << 20} {
+		sections, err := ChunksBySize(src, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := FileChunksWith(src, t.TempDir(), sections, quiet(Options{Workers: 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, err := names.Paths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readChunks(t, paths); got != data {
+			t.Fatalf("size %d: chunks hold %d bytes, want %d", size, len(got), len(data))
+		}
+	}
+}
+
+func TestFileChunksInvalidSections(t *testing.T) {
+	src := writeSource(t, lines(1, 10))
+	for _, s := range []Section{{-1, 5}, {6, 5}, {0, 1000}} {
+		_, err := FileChunksWith(src, t.TempDir(), []Section{{0, 5}, s}, quiet(Options{}))
+		if err == nil || !strings.Contains(err.Error(), "invalid section 1") {
+			t.Errorf("section %v: got %v, want it found invalid", s, err)
+		}
+	}
+}
+
+func TestEmptySections(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "chunks")
+	res, err := ChunkFileWith(writeSource(t, ""), dir, quiet(Options{Size: 10}))
+	if err != nil || len(res.Chunks) != 0 {
+		t.Fatalf("empty source gave %d chunks: %v", len(res.Chunks), err)
+	}
+
+	data := strings.Repeat("a\n\n", 200)
+	src := writeSource(t, data)
+	for size := int64(1); size < 8; size++ {
+		res, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "chunks"), quiet(Options{Size: size}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, _ := res.Paths()
+		for _, c := range res.Chunks {
+			if c.Size == 0 {
+				t.Fatalf("size %d: chunk %d is empty", size, c.Index)
+			}
+		}
+		if got := readChunks(t, paths); got != data {
+			t.Fatalf("size %d: chunks hold %d bytes, want %d", size, len(got), len(data))
+		}
+	}
+
+	sections := []Section{{0, 3}, {3, 3}, {3, 6}}
+	res, err = FileChunksWith(src, t.TempDir(), sections, quiet(Options{}))
+	if err != nil || len(res.Chunks) != 2 {
+		t.Fatalf("got %d chunks, want the empty section dropped: %v", len(res.Chunks), err)
+	}
+}
+
+// faultyReaderAt fails reads covering the offset bad
+type faultyReaderAt struct {
+	ReaderAt
+	bad int64
+}
+
+var errFault = errors.New("injected read fault")
+
+func (f faultyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off <= f.bad && f.bad < off+int64(len(p)) {
+		return 0, errFault
+	}
+	return f.ReaderAt.ReadAt(p, off)
+}
+
+func TestChunkReaderReadError(t *testing.T) {
+	// the fault is in the middle of the first chunk, clear of the page
+	// searched for its end
+	r := faultyReaderAt{NewBytesReaderAt([]byte(lines(1, 500))), 500}
+	opts := quiet(Options{Size: 1000, SearchPage: 64, Workers: 1})
+	_, err := NewChunker(opts).ChunkReader(r, filepath.Join(t.TempDir(), "chunks"))
+	if !errors.Is(err, errFault) {
+		t.Fatalf("got %v, want the read fault", err)
+	}
+}
+
+func TestSourceChanged(t *testing.T) {
+	src := writeSource(t, lines(1, 100))
+	opts := quiet(Options{Size: 100, Workers: 1, Progress: func(p Progress) {
+		if p.Chunks == 1 {
+			os.WriteFile(src, []byte(lines(1, 200)), 0644)
+		}
+	}})
+	_, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "chunks"), opts)
+	if err == nil || !strings.Contains(err.Error(), "changed while being chunked") {
+		t.Fatalf("got %v, want the change detected", err)
+	}
+}
+
+func TestUnwritableDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write anywhere")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	_, err := ChunkFileWith(writeSource(t, lines(1, 10)), dir, quiet(Options{}))
+	if err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Fatalf("got %v, want the directory found unwritable", err)
+	}
+}
+
+// slowSink is a sink whose writes each take delay
+type slowSink struct {
+	delay time.Duration
+}
+
+func (s slowSink) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return len(p), nil
+}
+
+func (s slowSink) Close() error { return nil }
+
+func TestPerChunkTimeout(t *testing.T) {
+	src := writeSource(t, lines(1, 100))
+	opts := quiet(Options{
+		Size:            400,
+		PerChunkTimeout: 10 * time.Millisecond,
+		Sink: func(string) (io.WriteCloser, error) {
+			return slowSink{100 * time.Millisecond}, nil
+		},
+	})
+	_, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "chunks"), opts)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	opts.KeepGoing = true
+	res, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "chunks"), opts)
+	if err == nil || !strings.Contains(err.Error(), "chunks failed") {
+		t.Fatalf("got %v, want every chunk to have been tried", err)
+	}
+	if len(res.Chunks) != 0 {
+		t.Errorf("got %d chunks, want none complete", len(res.Chunks))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFileList reads a list of source files, one per line,
+// ignoring blank lines and # comments
+func readFileList(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	return files, scanner.Err()
+}
+
+// sourceDir is where the chunks of one of several sources are written,
+// a subdirectory of dir named for the source without its extension
+func sourceDir(dir, source string) string {
+	base := filepath.Base(source)
+	return filepath.Join(dir, strings.TrimSuffix(base, sourceExt(base)))
+}
+
+// sourceDirs returns the sourceDir under dest of each source, keeping
+// the layout of the sources under root if it is set, and fails if two
+// would share one, as their chunks would overwrite each other
+func sourceDirs(dest, root string, sources []string) ([]string, error) {
+	dirs := make([]string, len(sources))
+	seen := make(map[string]string, len(sources))
+	for i, source := range sources {
+		dir := dest
+		if root != "" {
+			rel, err := filepath.Rel(root, source)
+			if err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(dest, filepath.Dir(rel))
+		}
+		dirs[i] = sourceDir(dir, source)
+		if other, ok := seen[dirs[i]]; ok {
+			return nil, fmt.Errorf("%q and %q would both be chunked into %q", other, source, dirs[i])
+		}
+		seen[dirs[i]] = source
+	}
+	return dirs, nil
+}
+
+// walkSources lists the regular files under root, in lexical order,
+// leaving out skip so that chunks written inside root aren't chunked
+func walkSources(root, skip string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && name != root && filepath.Clean(name) == filepath.Clean(skip) {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const streamBufferSize = 1 << 20
+
+// IncompletePolicy says what to do with a final record
+// that has no trailing newline
+type IncompletePolicy int
+
+const (
+	// EmitIncomplete writes the partial record at the end of the final chunk
+	EmitIncomplete IncompletePolicy = iota
+
+	// HoldIncomplete leaves the partial record out of the output and
+	// returns it instead, e.g. when tailing a file still being written
+	HoldIncomplete
+)
+
+// ChunkStream is the streaming analog of chunkyBySize for sources that
+// can't be mmapped (pipes, decompressed input). It reads size bytes at a
+// time, ended where chunkyBySize would end them, and hands each chunk to
+// fn in order, so lines longer than a page simply grow the chunk. The
+// final chunk may lack a trailing newline.
+//
+// The chunk slice is only valid until fn returns.
+func ChunkStream(r io.Reader, size int64, fn func(idx int, chunk []byte) error) error {
+	_, err := ChunkStreamWith(r, size, EmitIncomplete, fn)
+	return err
+}
+
+// ChunkStreamWith is ChunkStream with a policy for an incomplete final
+// record. Under HoldIncomplete the record is returned rather than emitted
+// (nil if the input ends with a newline), and a final chunk consisting
+// only of that record is not emitted at all.
+func ChunkStreamWith(r io.Reader, size int64, policy IncompletePolicy, fn func(idx int, chunk []byte) error) ([]byte, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid chunk size: %d", size)
+	}
+	var hold *holdReader
+	if policy == HoldIncomplete {
+		hold = newHoldReader(r, '\n')
+		r = hold
+	}
+	br := bufio.NewReaderSize(r, streamBufferSize)
+	var chunk bytes.Buffer
+	for idx := 0; ; idx++ {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		chunk.Reset()
+		if _, err := chunk.ReadFrom(newLineChunkReader(br, size, DefaultSearchPage, '\n')); err != nil {
+			return nil, err
+		}
+		if err := fn(idx, chunk.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return hold.held(), nil
+}
+
+// holdReader reads r, holding back whatever follows the last delim
+// until more is read, so that an incomplete record at the end of r is
+// never returned
+type holdReader struct {
+	r     io.Reader
+	delim byte
+	buf   []byte
+	pos   int // start of what's left to return
+	ready int // end of what can be returned, just past a delim
+	eof   bool
+}
+
+func newHoldReader(r io.Reader, delim byte) *holdReader {
+	return &holdReader{r: r, delim: delim, buf: make([]byte, 0, streamBufferSize)}
+}
+
+func (h *holdReader) Read(p []byte) (int, error) {
+	for h.pos == h.ready {
+		if h.eof {
+			return 0, io.EOF
+		}
+		// keep only what's held back, making room for more
+		h.buf = h.buf[:copy(h.buf, h.buf[h.pos:])]
+		h.pos, h.ready = 0, 0
+		if len(h.buf) == cap(h.buf) {
+			h.buf = append(h.buf, make([]byte, len(h.buf))...)[:len(h.buf)]
+		}
+		n, err := h.r.Read(h.buf[len(h.buf):cap(h.buf)])
+		h.buf = h.buf[:len(h.buf)+n]
+		h.ready = bytes.LastIndexByte(h.buf, h.delim) + 1
+		if err == io.EOF {
+			h.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, h.buf[h.pos:h.ready])
+	h.pos += n
+	return n, nil
+}
+
+// held returns the incomplete record held back at the end of r,
+// or nil if there is none or h is nil
+func (h *holdReader) held() []byte {
+	if h == nil || !h.eof || h.ready == len(h.buf) {
+		return nil
+	}
+	return append([]byte(nil), h.buf[h.ready:]...)
+}
+
+// stream carves r into chunks one after another, split as
+// sectionsBySize would split the same bytes but without holding a chunk
+// in memory, which needs r to buffer at least opts.SearchPage. Each is written under a
+// temporary name and renamed once its end, and so its name, is known.
+// The first chunk starts at off.
+func (c *carver) stream(r *bufio.Reader, off int64) error {
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		i := c.next()
+		tmp := filepath.Join(c.dir, fmt.Sprintf(".shred-stream-%d.tmp", i))
+		copts, h := c.carveOptions(c.opts.Size)
+		copts.Atomic = false
+		n, err := CarveWith(c.withHeader(off, newLineChunkReader(r, c.opts.Size, c.opts.SearchPage, c.opts.delim())), tmp, copts)
+		if err != nil {
+			return fmt.Errorf("carving section %d: %w", i, err)
+		}
+		carved := n
+		if off > 0 {
+			carved -= int64(len(c.header))
+		}
+		s := Section{off, off + carved}
+		off = s.end
+		filename, err := c.name(i, s)
+		if err == nil {
+			err = os.Rename(tmp, filename)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("naming section %d: %w", i, err)
+		}
+		c.record(Chunk{Index: i, Name: filename, Section: s, Size: n}, h)
+	}
+}
+
+// lineChunkReader reads a chunk of r ended as sectionsBySize ends
+// one: on the last delim in the final page of size bytes or, if the
+// page has none, the first delim after it
+type lineChunkReader struct {
+	r     *bufio.Reader
+	delim byte
+	left  int64 // bytes before the final page
+	page  int
+	tail  int64 // bytes of the final page to read, -1 until known
+	runOn bool  // read on to the end of the line after the page
+}
+
+func newLineChunkReader(r *bufio.Reader, size, page int64, delim byte) *lineChunkReader {
+	if page > size {
+		page = size
+	}
+	return &lineChunkReader{r: r, delim: delim, left: size - page, page: int(page), tail: -1}
+}
+
+func (l *lineChunkReader) Read(p []byte) (int, error) {
+	if l.left > 0 {
+		if int64(len(p)) > l.left {
+			p = p[:l.left]
+		}
+		n, err := l.r.Read(p)
+		l.left -= int64(n)
+		return n, err
+	}
+	if l.tail < 0 {
+		buf, err := l.r.Peek(l.page)
+		switch {
+		case err == io.EOF:
+			// the source ends within the page
+			l.tail = int64(len(buf))
+		case err != nil:
+			return 0, err
+		default:
+			if i := bytes.LastIndexByte(buf, l.delim); i >= 0 {
+				l.tail = int64(i) + 1
+			} else {
+				l.tail, l.runOn = int64(len(buf)), true
+			}
+		}
+	}
+	if l.tail > 0 {
+		if int64(len(p)) > l.tail {
+			p = p[:l.tail]
+		}
+		n, err := l.r.Read(p)
+		l.tail -= int64(n)
+		return n, err
+	}
+	if !l.runOn {
+		return 0, io.EOF
+	}
+	if _, err := l.r.Peek(1); err != nil {
+		l.runOn = false
+		return 0, err
+	}
+	buf, _ := l.r.Peek(l.r.Buffered())
+	if i := bytes.IndexByte(buf, l.delim); i >= 0 {
+		buf = buf[:i+1]
+		l.runOn = len(p) < len(buf)
+	}
+	n := copy(p, buf)
+	l.r.Discard(n)
+	return n, nil
+}
+
+// skipStream reads past the lines that opts.Skip and opts.SkipUntil
+// skip, returning the rest of r and the number of bytes skipped
+func skipStream(r *bufio.Reader, opts Options) (*bufio.Reader, int64, error) {
+	var off int64
+	for found := 0; found < opts.Skip; {
+		line, err := r.ReadBytes(opts.delim())
+		if len(line) > 0 {
+			found++
+			off += int64(len(line))
+		}
+		if err == io.EOF && found < opts.Skip {
+			return nil, 0, fmt.Errorf("failed to skip lines: only %d of %d lines found", found, opts.Skip)
+		}
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+	}
+	if opts.SkipUntil == nil {
+		return r, off, nil
+	}
+	for {
+		line, err := r.ReadBytes(opts.delim())
+		if len(line) > 0 && opts.SkipUntil.Match(trimDelim(line, opts.delim())) {
+			// the matching line is the first to keep
+			return bufio.NewReaderSize(io.MultiReader(bytes.NewReader(line), r), r.Size()), off, nil
+		}
+		off += int64(len(line))
+		if err == io.EOF {
+			return nil, 0, fmt.Errorf("no line matches %q", opts.SkipUntil)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
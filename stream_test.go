@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// streamCases are sources with awkward boundaries for size
+var streamCases = []struct {
+	name string
+	data string
+	size int64
+}{
+	{"empty", "", 10},
+	{"exact", "abcd\nefgh\n", 5},
+	{"no trailing newline", "abcd\nefgh\nij", 5},
+	{"only newlines", "\n\n\n\n\n", 2},
+	{"line longer than size", strings.Repeat("x", 50) + "\nshort\n", 10},
+	{"line longer than the page", strings.Repeat("y", 3*DefaultSearchPage) + "\n" + lines(1, 500), 1000},
+	{"size of one", "a\nbc\n\nd", 1},
+}
+
+// randomSource is lines of random lengths, maybe without a last newline
+func randomSource(r *rand.Rand) string {
+	var b strings.Builder
+	for i := r.Intn(300); i > 0; i-- {
+		b.WriteString(strings.Repeat("z", r.Intn(60)))
+		b.WriteByte('\n')
+	}
+	if r.Intn(2) == 0 {
+		b.WriteString("partial")
+	}
+	return b.String()
+}
+
+// checkStreamParity fails unless ChunkStream splits data as chunkyBySize does
+func checkStreamParity(t *testing.T, data string, size int64) {
+	t.Helper()
+	want, err := chunkyBySize(NewBytesReaderAt([]byte(data)), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = ChunkStream(strings.NewReader(data), size, func(idx int, chunk []byte) error {
+		if idx != len(got) {
+			t.Fatalf("chunk %d given as %d", len(got), idx)
+		}
+		got = append(got, string(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data == "" {
+		want = nil
+	}
+	if len(got) != len(want) {
+		t.Fatalf("size %d: streamed %d chunks, mapped %d", size, len(got), len(want))
+	}
+	for i, s := range want {
+		if got[i] != data[s.off:s.end] {
+			t.Fatalf("size %d: chunk %d streamed as %q, mapped as %q", size, i, got[i], data[s.off:s.end])
+		}
+	}
+}
+
+func TestChunkStreamParity(t *testing.T) {
+	for _, tc := range streamCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkStreamParity(t, tc.data, tc.size)
+		})
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		checkStreamParity(t, randomSource(r), 1+r.Int63n(300))
+	}
+}
+
+func TestChunkStreamHold(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		held string
+	}{
+		{"a\nb\n", ""},
+		{"a\nb\nc", "c"},
+		{"", ""},
+		{"no newline at all", "no newline at all"},
+		{lines(1, 1000) + "partial", "partial"},
+	} {
+		var out bytes.Buffer
+		held, err := ChunkStreamWith(strings.NewReader(tc.data), 16, HoldIncomplete, func(_ int, chunk []byte) error {
+			if len(chunk) == 0 || chunk[len(chunk)-1] != '\n' {
+				t.Fatalf("chunk %q doesn't end with a newline", chunk)
+			}
+			out.Write(chunk)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(held) != tc.held || out.String()+string(held) != tc.data {
+			t.Errorf("held %q of %q, want %q", held, tc.data, tc.held)
+		}
+		if tc.held == "" && held != nil {
+			t.Errorf("held %q, want nil", held)
+		}
+
+		out.Reset()
+		held, err = ChunkStreamWith(strings.NewReader(tc.data), 16, EmitIncomplete, func(_ int, chunk []byte) error {
+			out.Write(chunk)
+			return nil
+		})
+		if err != nil || held != nil || out.String() != tc.data {
+			t.Errorf("emitted %q, holding %q: %v, want all of %q", out.String(), held, err, tc.data)
+		}
+	}
+}
+
+// chunkFiles returns the base names and contents of the chunks of res
+func chunkFiles(t *testing.T, res Result) map[string]string {
+	t.Helper()
+	files := make(map[string]string, len(res.Chunks))
+	for _, c := range res.Chunks {
+		data, err := os.ReadFile(c.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.Base(c.Name)] = string(data)
+	}
+	return files
+}
+
+// checkSameChunks fails unless got and want hold the same files
+func checkSameChunks(t *testing.T, got, want Result) {
+	t.Helper()
+	gf, wf := chunkFiles(t, got), chunkFiles(t, want)
+	if len(gf) != len(wf) {
+		t.Fatalf("got %d chunks, want %d", len(gf), len(wf))
+	}
+	for name, data := range wf {
+		if gf[name] != data {
+			t.Fatalf("chunk %s differs", name)
+		}
+	}
+}
+
+func TestChunkStreamedMatchesFile(t *testing.T) {
+	data := "id\n" + lines(1, 2000) + "tail"
+	src := writeSource(t, data)
+	for _, opts := range []Options{
+		{Size: 1000},
+		{Size: 1000, Header: true},
+		{Size: 700, Skip: 3},
+		{Size: 5000, Delimiter: "5"},
+	} {
+		opts = quiet(opts)
+		opts.Ext = ".txt"
+		want, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "mapped"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewChunker(opts).ChunkStreamed(context.Background(), strings.NewReader(data), filepath.Join(t.TempDir(), "streamed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameChunks(t, got, want)
+		if got.Bytes != want.Bytes || got.Skipped != want.Skipped {
+			t.Errorf("%+v: streamed %d bytes skipping %d, mapped %d skipping %d", opts, got.Bytes, got.Skipped, want.Bytes, want.Skipped)
+		}
+	}
+}
+
+func TestChunkGzipMatchesFile(t *testing.T) {
+	data := lines(1, 3000)
+	src := writeSource(t, data)
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	zw.Write([]byte(data))
+	zw.Close()
+	zsrc := src + gzipExt
+	if err := os.WriteFile(zsrc, zb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := quiet(Options{Size: 2000})
+	want, err := ChunkFileWith(src, filepath.Join(t.TempDir(), "plain"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ChunkFileWith(zsrc, filepath.Join(t.TempDir(), "gzipped"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameChunks(t, got, want)
+
+	if _, err := ChunkFileFrom(zsrc, t.TempDir(), 0, opts); err == nil {
+		t.Error("appending the chunks of a gzipped source succeeded")
+	}
+	if err := IndexFileWith(zsrc, filepath.Join(t.TempDir(), "index"), opts); err == nil {
+		t.Error("indexing a gzipped source succeeded")
+	}
+}
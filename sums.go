@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SumsFile names the checksum file written alongside the chunks,
+// in the format of sha256sum(1) so it can also be checked with
+// `sha256sum -c SHA256SUMS`. Other algorithms are written to their
+// own file, e.g. MD5SUMS for md5sum(1).
+const SumsFile = "SHA256SUMS"
+
+// DefaultChecksumAlgo is the checksum algorithm unless another is chosen
+const DefaultChecksumAlgo = "sha256"
+
+// checksumAlgo is an algorithm checksums can be made with
+type checksumAlgo struct {
+	name string
+	file string
+	new  func() hash.Hash
+}
+
+// checksumAlgos are the algorithms available, in the order
+// their files are looked for when verifying
+var checksumAlgos = []checksumAlgo{
+	{"sha256", SumsFile, sha256.New},
+	{"sha512", "SHA512SUMS", sha512.New},
+	{"sha1", "SHA1SUMS", sha1.New},
+	{"md5", "MD5SUMS", md5.New},
+	// not cryptographic, but cheap enough to catch corruption in transit
+	{"crc32", "CRC32SUMS", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// lookupAlgo returns the checksum algorithm called name,
+// DefaultChecksumAlgo if name is empty
+func lookupAlgo(name string) (checksumAlgo, error) {
+	if name == "" {
+		name = DefaultChecksumAlgo
+	}
+	for _, a := range checksumAlgos {
+		if a.name == strings.ToLower(name) {
+			return a, nil
+		}
+	}
+	return checksumAlgo{}, fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// findSums reads the checksum file for algo in dir or metaDir, or with
+// no algo, that of the first algorithm whose file is there
+func findSums(dir, metaDir, algo string) (checksumAlgo, []sumEntry, error) {
+	if algo != "" {
+		a, err := lookupAlgo(algo)
+		if err != nil {
+			return a, nil, err
+		}
+		sums, err := readSums(dir, metaDir, a.file)
+		return a, sums, err
+	}
+	for _, a := range checksumAlgos {
+		sums, err := readSums(dir, metaDir, a.file)
+		if !os.IsNotExist(err) {
+			return a, sums, err
+		}
+	}
+	return checksumAlgo{}, nil, fmt.Errorf("no checksum file found in %q", metaPath(dir, metaDir, ""))
+}
+
+// sumEntry is a line of a checksum file
+type sumEntry struct {
+	name string
+	sum  []byte
+}
+
+// metaPath returns the path of a metadata file named name, which lives
+// in metaDir if given or else alongside the chunks in dir
+func metaPath(dir, metaDir, name string) string {
+	if metaDir != "" {
+		dir = metaDir
+	}
+	return filepath.Join(dir, name)
+}
+
+// createMeta creates a metadata file, where a metaDir of "-"
+// means stdout. With compress the file is gzipped and named
+// with a ".gz" extension, except on stdout.
+func createMeta(dir, metaDir, name string, compress bool) (io.WriteCloser, error) {
+	if metaDir == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	if metaDir != "" {
+		if err := os.MkdirAll(metaDir, fs.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	if !compress {
+		return os.Create(metaPath(dir, metaDir, name))
+	}
+	f, err := os.Create(metaPath(dir, metaDir, name+gzipExt))
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{gzip.NewWriter(f), f}, nil
+}
+
+// openMeta opens a metadata file, or failing that its gzipped
+// version, returning the path of the one opened
+func openMeta(dir, metaDir, name string) (io.ReadCloser, string, error) {
+	filename := metaPath(dir, metaDir, name)
+	f, err := os.Open(filename)
+	if err == nil {
+		return f, filename, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, filename, err
+	}
+	gf, gerr := os.Open(filename + gzipExt)
+	if gerr != nil {
+		if os.IsNotExist(gerr) {
+			// neither, so report the one that was expected
+			return nil, filename, err
+		}
+		return nil, filename + gzipExt, gerr
+	}
+	zr, err := gzip.NewReader(gf)
+	if err != nil {
+		gf.Close()
+		return nil, filename + gzipExt, err
+	}
+	return &gzipReader{zr, gf}, filename + gzipExt, nil
+}
+
+// gzipExt is the extension of gzipped metadata files
+const gzipExt = ".gz"
+
+// gzipWriter gzips to a file, closing both together
+type gzipWriter struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (w *gzipWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// gzipReader reads a gzipped file, closing both together
+type gzipReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// writeSums writes the algo checksums of the chunks in dir to metaDir,
+// after those of prior chunks already there
+func writeSums(dir, metaDir string, compress bool, algo checksumAlgo, prior []sumEntry, chunks []Chunk) error {
+	f, err := createMeta(dir, metaDir, algo.file, compress)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range prior {
+		fmt.Fprintf(w, "%x  %s\n", e.sum, e.name)
+	}
+	for _, c := range chunks {
+		fmt.Fprintf(w, "%x  %s\n", c.Sum, filepath.Base(c.Name))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readSums reads the checksum file name in dir or metaDir,
+// which may have been gzipped
+func readSums(dir, metaDir, name string) ([]sumEntry, error) {
+	f, filename, err := openMeta(dir, metaDir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sums []sumEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		i := strings.IndexByte(text, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid checksum line", filename, line)
+		}
+		sum, err := hex.DecodeString(text[:i])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid checksum: %w", filename, line, err)
+		}
+		// the name is preceded by a space for text mode or '*' for binary
+		name := text[i+1:]
+		if len(name) > 0 && (name[0] == ' ' || name[0] == '*') {
+			name = name[1:]
+		}
+		sums = append(sums, sumEntry{name, sum})
+	}
+	return sums, scanner.Err()
+}
+
+// checkSum compares the algo checksum of filename with sum
+func checkSum(filename string, algo checksumAlgo, sum []byte) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := algo.new()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("%s: checksum mismatch", filename)
+	}
+	return nil
+}
+
+// verifySums checks each entry's file in dir, returning one error
+// describing every missing or corrupt file
+func verifySums(dir string, algo checksumAlgo, sums []sumEntry) error {
+	var bad []string
+	for _, e := range sums {
+		if err := checkSum(filepath.Join(dir, e.name), algo, e.sum); err != nil {
+			bad = append(bad, err.Error())
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d of %d chunks failed verification:\n%s", len(bad), len(sums), strings.Join(bad, "\n"))
+	}
+	return nil
+}
+
+// Verify checks every chunk listed in dir's checksum file against its
+// checksum, the algorithm being inferred from which file is there
+func Verify(dir string) error {
+	return VerifyMeta(dir, "")
+}
+
+// VerifyMeta is Verify for chunks whose checksum file was written to metaDir
+func VerifyMeta(dir, metaDir string) error {
+	return VerifyAlgo(dir, metaDir, "")
+}
+
+// VerifyAlgo is VerifyMeta with the checksum algorithm given explicitly,
+// e.g. "md5", or inferred if algo is empty
+func VerifyAlgo(dir, metaDir, algo string) error {
+	a, sums, err := findSums(dir, metaDir, algo)
+	if err != nil {
+		return err
+	}
+	return verifySums(dir, a, sums)
+}